@@ -10,6 +10,24 @@ type MountStatus struct {
 	File     string
 	ReadOnly bool
 	CDROM    bool
+	LUNs     []MountStatus // LUNs after the first, configfs only
+
+	Attributes LUNAttributes // configfs only
+}
+
+// LUNAttributes are optional settings of a configfs LUN. Unset ones are
+// put back to the kernel defaults on mount.
+type LUNAttributes struct {
+	Removable *bool  `json:"removable,omitempty"`
+	NoFUA     *bool  `json:"nofua,omitempty"`
+	Inquiry   string `json:"inquiry,omitempty"` // vendor, product and revision, e.g. "Linux   File-CD Gadget   0404"
+}
+
+// LUN is one image of a multi-LUN mount
+type LUN struct {
+	File string
+	MountOptions
+	LUNAttributes
 }
 
 type Backend interface {
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const blkGetSize64 = 0x80081272
+
+// byNameDirs hold the Android partition name links
+var byNameDirs = []string{
+	"/dev/block/by-name",
+	"/dev/block/bootdevice/by-name",
+	"/dev/block/platform/*/by-name",
+	"/dev/block/platform/*/*/by-name",
+}
+
+// isBlockDevice reports whether path is a block device node
+func isBlockDevice(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0
+}
+
+// deviceNumber returns the major:minor of a block device node
+func deviceNumber(path string) (uint32, uint32, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, 0, err
+	}
+	dev := uint64(st.Rdev)
+	major := uint32((dev>>8)&0xfff | (dev>>32)&^0xfff)
+	minor := uint32(dev&0xff | (dev>>12)&^0xff)
+	return major, minor, nil
+}
+
+// blockDeviceSize returns the size of a block device in bytes
+func blockDeviceSize(path string) (int64, error) {
+	dev, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer dev.Close()
+
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, fmt.Errorf("BLKGETSIZE64: %w", errno)
+	}
+	return int64(size), nil
+}
+
+// imageSize returns the size of an image file or block device
+func imageSize(path string) (int64, error) {
+	if isBlockDevice(path) {
+		return blockDeviceSize(path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// sysfsBlockDir returns the sysfs directory of a block device number, e.g.
+// /sys/devices/.../mmcblk1/mmcblk1p1
+func sysfsBlockDir(major, minor uint32) (string, error) {
+	return filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+}
+
+// validateBlockDevice checks that a block device can be handed to the host
+// without pulling it out from under Android.
+func validateBlockDevice(path string) error {
+	if !isBlockDevice(path) {
+		return fmt.Errorf("not a block device: %s", path)
+	}
+
+	major, minor, err := deviceNumber(path)
+	if err != nil {
+		return fmt.Errorf("stat device: %w", err)
+	}
+	sysDir, err := sysfsBlockDir(major, minor)
+	if err != nil {
+		return fmt.Errorf("find device in sysfs: %w", err)
+	}
+	name := filepath.Base(sysDir)
+
+	// The device and all of its partitions must be unused
+	devices := map[string]string{fmt.Sprintf("%d:%d", major, minor): name}
+	entries, _ := os.ReadDir(sysDir)
+	for _, entry := range entries {
+		partDir := filepath.Join(sysDir, entry.Name())
+		if !fileExists(filepath.Join(partDir, "partition")) {
+			continue
+		}
+		if dev, err := readFile(filepath.Join(partDir, "dev")); err == nil {
+			devices[dev] = entry.Name()
+		}
+	}
+
+	swaps := swapDevices()
+	for dev, devName := range devices {
+		if swap, ok := swaps[dev]; ok {
+			return fmt.Errorf("%s is in use as swap (%s)", devName, swap)
+		}
+		if where := deviceMountPoint(dev, devName); where != "" {
+			return fmt.Errorf("%s is mounted on %s\nHint: Unmount or eject the storage in Android settings first", devName, where)
+		}
+		holders, _ := os.ReadDir(filepath.Join("/sys/class/block", devName, "holders"))
+		if len(holders) > 0 {
+			return fmt.Errorf("%s is in use by %s", devName, holders[0].Name())
+		}
+	}
+
+	if partName := systemPartitionName(major, minor, name); partName != "" {
+		return fmt.Errorf("refusing to expose system partition or disk: %s (%s)", name, partName)
+	}
+
+	size, err := blockDeviceSize(path)
+	if err != nil {
+		return fmt.Errorf("read device size: %w", err)
+	}
+	if size == 0 {
+		return fmt.Errorf("block device is empty (no media?): %s", path)
+	}
+
+	logger.Info("Validated block device", "device", name, "size", size)
+	return nil
+}
+
+// swapDevices returns the block devices in use as swap, by major:minor,
+// e.g. zram0
+func swapDevices() map[string]string {
+	swaps := map[string]string{}
+	file, err := os.Open("/proc/swaps")
+	if err != nil {
+		return swaps
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		path := unescapeMount(fields[0])
+		if !isBlockDevice(path) {
+			continue
+		}
+		if major, minor, err := deviceNumber(path); err == nil {
+			swaps[fmt.Sprintf("%d:%d", major, minor)] = path
+		}
+	}
+	return swaps
+}
+
+// deviceMountPoint returns where a device is mounted according to
+// mountinfo or /proc/mounts, or "" if it is not mounted
+func deviceMountPoint(dev, name string) string {
+	if file, err := os.Open("/proc/self/mountinfo"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 5 && fields[2] == dev {
+				return fields[4]
+			}
+		}
+	}
+
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		if filepath.Base(fields[0]) == name {
+			return fields[1]
+		}
+		if source, err := filepath.EvalSymlinks(fields[0]); err == nil && filepath.Base(source) == name {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// systemPartitionName returns the by-name label if the device is a named
+// Android partition, or the disk that holds named partitions
+func systemPartitionName(major, minor uint32, name string) string {
+	for _, pattern := range byNameDirs {
+		dirs, _ := filepath.Glob(pattern)
+		for _, dir := range dirs {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				link := filepath.Join(dir, entry.Name())
+				partMajor, partMinor, err := deviceNumber(link)
+				if err != nil {
+					continue
+				}
+				if partMajor == major && partMinor == minor {
+					return entry.Name()
+				}
+				// Whole disk containing the named partition
+				if partDir, err := sysfsBlockDir(partMajor, partMinor); err == nil && filepath.Base(filepath.Dir(partDir)) == name {
+					return "disk holding " + entry.Name()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// blockDeviceIdentity describes a block device for status output, e.g.
+// "mmcblk1p1 (179:97), 29.72 GB, SD SC32G serial 0x1234abcd"
+func blockDeviceIdentity(path string) string {
+	major, minor, err := deviceNumber(path)
+	if err != nil {
+		return path
+	}
+	identity := fmt.Sprintf("%d:%d", major, minor)
+
+	sysDir, err := sysfsBlockDir(major, minor)
+	if err != nil {
+		return identity
+	}
+	name := filepath.Base(sysDir)
+	identity = fmt.Sprintf("%s (%d:%d)", name, major, minor)
+
+	if size, err := blockDeviceSize(path); err == nil {
+		identity += fmt.Sprintf(", %.2f GB", float64(size)/1000/1000/1000)
+	}
+
+	// Partitions keep the hardware details on their parent disk
+	diskDir := sysDir
+	if fileExists(filepath.Join(sysDir, "partition")) {
+		diskDir = filepath.Dir(sysDir)
+	}
+	var details []string
+	for _, attr := range []string{"type", "vendor", "model", "name", "serial"} {
+		value, err := readFile(filepath.Join(diskDir, "device", attr))
+		if err != nil || value == "" {
+			continue
+		}
+		if attr == "serial" {
+			value = "serial " + value
+		}
+		details = append(details, value)
+	}
+	if len(details) > 0 {
+		identity += ", " + strings.Join(details, " ")
+	}
+	return identity
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultBootTimeout bounds how long boot waits for Android and the gadget
+	defaultBootTimeout = 5 * time.Minute
+	// bootRetryDelay caps the backoff between boot retries
+	bootRetryDelay = 10 * time.Second
+)
+
+// waitBootCompleted waits for Android to set sys.boot_completed
+func waitBootCompleted(deadline time.Time) error {
+	getprop, err := exec.LookPath("getprop")
+	if err != nil {
+		logger.Info("No getprop, not waiting for Android to boot")
+		return nil
+	}
+	logger.Info("Waiting for boot to complete")
+	return retryBackoff(deadline, bootRetryDelay, nil, func() error {
+		out, err := exec.Command(getprop, "sys.boot_completed").Output()
+		if err != nil {
+			return fmt.Errorf("getprop: %w", err)
+		}
+		if strings.TrimSpace(string(out)) != "1" {
+			return fmt.Errorf("boot not completed")
+		}
+		return nil
+	})
+}
+
+// ensureConfigFS mounts configfs if the kernel has it but init hasn't
+// mounted it, as the configfs backend needs it
+func ensureConfigFS() error {
+	for _, dir := range []string{"/sys/kernel/config", "/config"} {
+		if dirExists(dir + "/usb_gadget") {
+			return nil
+		}
+	}
+	if !dirExists("/sys/kernel/config") {
+		return nil
+	}
+	err := syscall.Mount("configfs", "/sys/kernel/config", "configfs", 0, "")
+	if err != nil && err != syscall.EBUSY {
+		return fmt.Errorf("mount configfs: %w", err)
+	}
+	if err == nil {
+		logger.Info("Mounted configfs", "path", "/sys/kernel/config")
+	}
+	return nil
+}
+
+// waitGadget waits until a backend can mount, which for configfs means
+// init has bound its gadget to a controller
+func waitGadget(deadline time.Time) error {
+	logger.Info("Waiting for the USB gadget")
+	return retryBackoff(deadline, bootRetryDelay, nil, func() error {
+		backend, err := selectBackend("")
+		if err != nil {
+			return err
+		}
+		if configfs, ok := backend.(*ConfigFSBackend); ok {
+			if _, err := configfs.findGadgetRoot(); err != nil {
+				return err
+			}
+		}
+		logger.Info("USB gadget is ready", "backend", backend.Name())
+		return nil
+	})
+}
+
+// mountWithRetry runs a mount, retrying while the gadget is busy, which it
+// can be for a moment while init reconfigures USB after boot
+func mountWithRetry(deadline time.Time, mount func() error) error {
+	attempt := 0
+	return retryBackoff(deadline, bootRetryDelay, func(err error) bool {
+		return errors.Is(err, syscall.EBUSY)
+	}, func() error {
+		attempt++
+		err := mount()
+		if errors.Is(err, syscall.EBUSY) {
+			logger.Warn("USB gadget is busy, retrying", "attempt", attempt, "error", err)
+		}
+		return err
+	})
+}
+
+// logcatHandler sends log records to the Android log with the log tool,
+// since boot runs without a terminal
+type logcatHandler struct {
+	tool  string
+	level slog.Level
+	attrs []slog.Attr
+}
+
+func (h *logcatHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *logcatHandler) Handle(_ context.Context, record slog.Record) error {
+	var b strings.Builder
+	b.WriteString(record.Message)
+	add := func(attr slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", attr.Key, attr.Value)
+		return true
+	}
+	for _, attr := range h.attrs {
+		add(attr)
+	}
+	record.Attrs(add)
+
+	priority := "i"
+	switch {
+	case record.Level >= slog.LevelError:
+		priority = "e"
+	case record.Level >= slog.LevelWarn:
+		priority = "w"
+	}
+	return exec.Command(h.tool, "-t", "usbdrive", "-p", priority, b.String()).Run()
+}
+
+func (h *logcatHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logcatHandler{tool: h.tool, level: h.level, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+func (h *logcatHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// teeHandler passes log records to several handlers
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, record slog.Record) error {
+	var errs []error
+	for _, h := range t {
+		if h.Enabled(ctx, record.Level) {
+			errs = append(errs, h.Handle(ctx, record.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// bootLogger logs to stderr and, on Android, to logcat with tag usbdrive
+func bootLogger() *slog.Logger {
+	handlers := teeHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})}
+	if tool, err := exec.LookPath("log"); err == nil {
+		handlers = append(handlers, &logcatHandler{tool: tool, level: slog.LevelInfo})
+	}
+	return slog.New(handlers)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// imageUser is a process or loop device holding an image
+type imageUser struct {
+	PID     int
+	Command string
+	Writing bool
+	Loop    string
+	Mount   string
+}
+
+func (u imageUser) String() string {
+	if u.Loop != "" {
+		if u.Mount != "" {
+			return fmt.Sprintf("%s is backed by it (mounted on %s)", u.Loop, u.Mount)
+		}
+		return fmt.Sprintf("%s is backed by it", u.Loop)
+	}
+	access := "reading"
+	if u.Writing {
+		access = "writing"
+	}
+	return fmt.Sprintf("PID %d (%s) has it open for %s", u.PID, u.Command, access)
+}
+
+// sameFile reports whether info is the file or block device of target.
+// Comparing identities rather than paths catches the many aliases of
+// Android storage, e.g. /sdcard and /data/media/0.
+func sameFile(target, info os.FileInfo) bool {
+	if target.Mode()&os.ModeDevice != 0 {
+		a, ok1 := target.Sys().(*syscall.Stat_t)
+		b, ok2 := info.Sys().(*syscall.Stat_t)
+		return ok1 && ok2 && info.Mode()&os.ModeDevice != 0 && a.Rdev == b.Rdev
+	}
+	return os.SameFile(target, info)
+}
+
+// imageUsers lists the processes with path open and the loop devices
+// backed by it. Loop devices usbdrive attached itself are not reported.
+func imageUsers(path string) ([]imageUser, error) {
+	target, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []imageUser
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			// Processes exit while we scan, and kernel threads have no fds
+			continue
+		}
+		for _, fd := range fds {
+			info, err := os.Stat(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !sameFile(target, info) {
+				continue
+			}
+			command, _ := readFile(filepath.Join("/proc", proc.Name(), "comm"))
+			users = append(users, imageUser{
+				PID:     pid,
+				Command: command,
+				Writing: fdWritable(proc.Name(), fd.Name()),
+			})
+			break
+		}
+	}
+
+	ours := map[string]bool{}
+	if state, err := loadState(); err == nil {
+		for _, loop := range state.Loops {
+			ours[filepath.Base(loop.Device)] = true
+		}
+	}
+	loops, _ := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	for _, file := range loops {
+		name := filepath.Base(filepath.Dir(filepath.Dir(file)))
+		if ours[name] {
+			continue
+		}
+		backing, err := readFile(file)
+		if err != nil {
+			continue
+		}
+		// The kernel appends " (deleted)" once the backing file is gone
+		if info, err := os.Stat(backing); err != nil || !sameFile(target, info) {
+			continue
+		}
+		device := "/dev/block/" + name
+		if !pathExists(device) {
+			device = "/dev/" + name
+		}
+		users = append(users, imageUser{Loop: device, Mount: mountPointOf(name)})
+	}
+	return users, nil
+}
+
+// fdWritable reports whether a process opened a file descriptor for writing
+func fdWritable(pid, fd string) bool {
+	fdinfo, err := readFile(filepath.Join("/proc", pid, "fdinfo", fd))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(fdinfo, "\n") {
+		if value, ok := strings.CutPrefix(line, "flags:"); ok {
+			flags, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+			return err == nil && flags&syscall.O_ACCMODE != syscall.O_RDONLY
+		}
+	}
+	return false
+}
+
+// mountPointOf returns where a block device is mounted, if anywhere
+func mountPointOf(name string) string {
+	mounts, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && filepath.Base(fields[0]) == name {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// checkBusy refuses to expose images other processes or loop devices
+// hold when the host may write them, and warns when it only reads them
+func checkBusy(paths []string, writable, force bool) error {
+	for _, path := range paths {
+		users, err := imageUsers(path)
+		if err != nil {
+			logger.Warn("Failed to check whether image is in use", "path", path, "error", err)
+			continue
+		}
+		if len(users) == 0 {
+			continue
+		}
+
+		var lines []string
+		for _, user := range users {
+			lines = append(lines, "  "+user.String())
+		}
+		if writable && !force {
+			return fmt.Errorf("%s is in use:\n%s\nHint: Stop these users first, or use --force-busy to mount it anyway", path, strings.Join(lines, "\n"))
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s is in use, the host may see it change:\n%s\n", path, strings.Join(lines, "\n"))
+	}
+	return nil
+}
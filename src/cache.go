@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// defaultCacheLimit bounds the disk space used by generated images
+const defaultCacheLimit = 8 << 30
+
+const sparseBlockSize = 64 << 10
+
+func cacheDir() string {
+	return filepath.Join(stateDir, "cache")
+}
+
+// cachePath returns the cache location for an image derived from source.
+// The name changes whenever the source path, size or mtime changes, so a
+// stale cached copy is never reused.
+func cachePath(source string, info os.FileInfo, name string) string {
+	return cacheKeyPath(fmt.Sprintf("%s|%d|%d", source, info.Size(), info.ModTime().UnixNano()), name)
+}
+
+// cacheKeyPath returns the cache location for an image identified by key
+func cacheKeyPath(key, name string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(cacheDir(), hex.EncodeToString(sum[:8])+"-"+name)
+}
+
+// cacheLookup reports whether a cached image exists and marks it as
+// recently used.
+func cacheLookup(path string) bool {
+	if !fileExists(path) {
+		return false
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		logger.Warn("Failed to update cache timestamp", "path", path, "error", err)
+	}
+	return true
+}
+
+// cacheCreate produces a cache entry by calling fill with a temporary
+// file, and moves it into place only if fill succeeds.
+func cacheCreate(path string, fill func(*os.File) error) error {
+	if err := os.MkdirAll(cacheDir(), 0700); err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
+	}
+
+	tmp := path + ".part"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create cache file: %w", err)
+	}
+
+	if err := fill(file); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// evictCache removes least recently used cache entries until the cache
+// fits in limit bytes. Entries in keep and mounted images are never removed.
+func evictCache(limit int64, keep ...string) error {
+	entries, err := os.ReadDir(cacheDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	protected := map[string]bool{}
+	for _, path := range keep {
+		protected[path] = true
+	}
+	for _, path := range mountedFiles() {
+		protected[path] = true
+	}
+
+	type cacheEntry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var candidates []cacheEntry
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(cacheDir(), entry.Name())
+		size := allocatedSize(info)
+		total += size
+		if !protected[path] {
+			candidates = append(candidates, cacheEntry{path, size, info.ModTime()})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].modTime.Before(candidates[j].modTime)
+	})
+
+	for _, c := range candidates {
+		if total <= limit {
+			break
+		}
+		logger.Info("Evicting cached image", "path", c.path, "size", c.size)
+		if err := os.Remove(c.path); err != nil {
+			return fmt.Errorf("evict %s: %w", c.path, err)
+		}
+		total -= c.size
+	}
+
+	if total > limit {
+		logger.Warn("Image cache exceeds limit", "size", total, "limit", limit)
+	}
+	return nil
+}
+
+// allocatedSize returns the disk space used by a possibly sparse file
+func allocatedSize(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+// mountedFiles returns the image paths currently attached to a LUN,
+// including the devices and backing files beneath loop and device-mapper
+// devices
+func mountedFiles() []string {
+	var files []string
+	for _, backend := range []Backend{&ConfigFSBackend{}, &UDCBackend{}, &SysfsBackend{}} {
+		if !backend.Supported() {
+			continue
+		}
+		status, err := backend.Status()
+		if err != nil || !status.Mounted {
+			continue
+		}
+		lunFiles := []string{status.File}
+		for _, lun := range status.LUNs {
+			if lun.Mounted {
+				lunFiles = append(lunFiles, lun.File)
+			}
+		}
+		for _, file := range lunFiles {
+			files = append(files, file)
+			if backing := loopBacking(file); backing != "" {
+				files = append(files, backing)
+			}
+			// Devices under a snapshot or linear mapping are in use too
+			for _, slave := range dmSlaves(file) {
+				files = append(files, slave)
+				if backing := loopBacking(slave); backing != "" {
+					files = append(files, backing)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// copySparse copies src into the empty file dst, seeking over all-zero
+// blocks instead of writing them so the result is a sparse file.
+func copySparse(dst *os.File, src io.Reader) (int64, error) {
+	written, err := copySparseAt(dst, 0, src)
+	if err != nil {
+		return written, err
+	}
+	// Extend the file over any trailing hole
+	return written, dst.Truncate(written)
+}
+
+// copySparseAt copies src into dst at offset, skipping all-zero blocks.
+// The destination range must already read as zeros.
+func copySparseAt(dst *os.File, offset int64, src io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlockSize)
+	var written int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 && !isZero(buf[:n]) {
+			if _, err := dst.WriteAt(buf[:n], offset+written); err != nil {
+				return written, err
+			}
+		}
+		written += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	composeAlign      = 2048 // partitions start on 1 MiB boundaries
+	gptEntries        = 128
+	gptEntrySize      = 128
+	gptEntriesSectors = gptEntries * gptEntrySize / 512
+)
+
+// ComposeSpec describes a virtual disk assembled from partition images
+type ComposeSpec struct {
+	Table      string             `json:"table,omitempty"` // "gpt" (default) or "mbr"
+	Partitions []ComposePartition `json:"partitions"`
+}
+
+// ComposePartition is one partition of a composed disk: an image file, or
+// a scratch area of the given size kept in the state directory
+type ComposePartition struct {
+	File string `json:"file,omitempty"`
+	Size string `json:"size,omitempty"`
+	Type string `json:"type,omitempty"` // "efi", "data", "linux", "swap", a GUID, or an MBR type such as "0x0c"
+	Name string `json:"name,omitempty"`
+}
+
+// partitionTypes maps type names to GPT type GUIDs and MBR type bytes
+var partitionTypes = map[string]struct {
+	guid string
+	mbr  byte
+}{
+	"efi":   {"C12A7328-F81F-11D2-BA4B-00A0C93EC93B", 0xef},
+	"data":  {"EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", 0x0c},
+	"linux": {"0FC63DAF-8483-4772-8E79-3D69D8477DE4", 0x83},
+	"swap":  {"0657FD6D-A4AB-43C4-84E5-0933C84B4F4F", 0x82},
+}
+
+// composedPart is a partition placed on the composed disk, in sectors
+type composedPart struct {
+	path    string
+	scratch bool
+	name    string
+	typeID  [16]byte
+	mbrType byte
+	start   int64
+	sectors int64
+}
+
+// composeLayout is the planned layout of a composed disk
+type composeLayout struct {
+	spec    string
+	key     string
+	gpt     bool
+	parts   []composedPart
+	sectors int64
+}
+
+// planCompose loads a compose spec and lays out its partitions. Relative
+// file paths are resolved against the spec's directory.
+func planCompose(specPath string) (*composeLayout, error) {
+	specPath, err := filepath.Abs(specPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(specPath)
+	if err != nil {
+		return nil, fmt.Errorf("read compose spec: %w", err)
+	}
+	var spec ComposeSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, fmt.Errorf("parse compose spec: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(specPath))
+	layout := &composeLayout{spec: specPath, key: hex.EncodeToString(sum[:8])}
+	switch spec.Table {
+	case "", "gpt":
+		layout.gpt = true
+	case "mbr":
+		if len(spec.Partitions) > 4 {
+			return nil, fmt.Errorf("an MBR holds at most 4 partitions, spec has %d", len(spec.Partitions))
+		}
+	default:
+		return nil, fmt.Errorf("invalid table: %s (must be gpt or mbr)", spec.Table)
+	}
+	if len(spec.Partitions) == 0 {
+		return nil, fmt.Errorf("compose spec has no partitions")
+	}
+	if layout.gpt && len(spec.Partitions) > gptEntries {
+		return nil, fmt.Errorf("too many partitions: %d", len(spec.Partitions))
+	}
+
+	for i, p := range spec.Partitions {
+		part := composedPart{name: p.Name}
+		if part.typeID, part.mbrType, err = parsePartitionType(p.Type, layout.gpt); err != nil {
+			return nil, fmt.Errorf("partition %d: %w", i+1, err)
+		}
+
+		var size int64
+		switch {
+		case p.File != "" && p.Size != "":
+			return nil, fmt.Errorf("partition %d: use either file or size, not both", i+1)
+		case p.File != "":
+			part.path = p.File
+			if !filepath.IsAbs(part.path) {
+				part.path = filepath.Join(filepath.Dir(specPath), part.path)
+			}
+			if err := validateImage(part.path); err != nil {
+				return nil, fmt.Errorf("partition %d: %w", i+1, err)
+			}
+			if size, err = imageSize(part.path); err != nil {
+				return nil, fmt.Errorf("partition %d: %w", i+1, err)
+			}
+		case p.Size != "":
+			part.scratch = true
+			part.path = filepath.Join(stateDir, "compose", fmt.Sprintf("%s-scratch%d.img", layout.key, i+1))
+			if size, err = parseSize(p.Size); err != nil || size == 0 {
+				return nil, fmt.Errorf("partition %d: invalid size: %s", i+1, p.Size)
+			}
+		default:
+			return nil, fmt.Errorf("partition %d: needs a file or a size", i+1)
+		}
+		if size%512 != 0 {
+			return nil, fmt.Errorf("partition %d: size %d is not a multiple of 512 bytes", i+1, size)
+		}
+
+		part.sectors = size / 512
+		layout.parts = append(layout.parts, part)
+	}
+
+	if err := layout.place(); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// place aligns the partitions one after another and sizes the disk
+func (l *composeLayout) place() error {
+	start := int64(composeAlign)
+	for i := range l.parts {
+		l.parts[i].start = start
+		start = (start + l.parts[i].sectors + composeAlign - 1) / composeAlign * composeAlign
+	}
+
+	l.sectors = start
+	if l.gpt {
+		// Backup partition entries and header
+		l.sectors += gptEntriesSectors + 1
+	} else if l.sectors > 0xffffffff {
+		return fmt.Errorf("disk too large for an MBR (use gpt)")
+	}
+	return nil
+}
+
+// parsePartitionType resolves a type name, GUID or MBR type byte
+func parsePartitionType(name string, gpt bool) ([16]byte, byte, error) {
+	if name == "" {
+		name = "data"
+	}
+	if known, ok := partitionTypes[strings.ToLower(name)]; ok {
+		return mustGUID(known.guid), known.mbr, nil
+	}
+	if guid, err := parseGUID(name); err == nil {
+		if !gpt {
+			return guid, 0, fmt.Errorf("GUID types need a gpt table: %s", name)
+		}
+		return guid, 0, nil
+	}
+	if value, err := strconv.ParseUint(name, 0, 8); err == nil && value != 0 {
+		if gpt {
+			return [16]byte{}, 0, fmt.Errorf("MBR types need an mbr table: %s", name)
+		}
+		return [16]byte{}, byte(value), nil
+	}
+	return [16]byte{}, 0, fmt.Errorf("unknown partition type: %s (use efi, data, linux, swap, a GUID or an MBR type byte)", name)
+}
+
+// deriveGUID returns a stable version 4 style GUID for a composed disk or
+// partition, so the host sees the same identifiers on every mount
+func deriveGUID(key string) [16]byte {
+	sum := sha256.Sum256([]byte(key))
+	var guid [16]byte
+	copy(guid[:], sum[:16])
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid
+}
+
+// headers returns the sectors in front of the first partition and, for
+// GPT, the backup table at the end of the disk
+func (l *composeLayout) headers() ([]byte, []byte) {
+	le := binary.LittleEndian
+	head := make([]byte, composeAlign*512)
+	mbr := head[:512]
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	if !l.gpt {
+		signature := deriveGUID(l.key + "|disk")
+		copy(mbr[440:444], signature[:4])
+		for i, part := range l.parts {
+			mbrEntry(mbr[mbrPartTableOff+i*mbrPartEntrySize:], part.mbrType, part.start, part.sectors)
+		}
+		return head, nil
+	}
+
+	protective := l.sectors - 1
+	if protective > 0xffffffff {
+		protective = 0xffffffff
+	}
+	mbrEntry(mbr[mbrPartTableOff:], 0xee, 1, protective)
+
+	entries := make([]byte, gptEntriesSectors*512)
+	for i, part := range l.parts {
+		e := entries[i*gptEntrySize:]
+		copy(e[0:], part.typeID[:])
+		guid := deriveGUID(fmt.Sprintf("%s|part%d", l.key, i+1))
+		copy(e[16:], guid[:])
+		le.PutUint64(e[32:], uint64(part.start))
+		le.PutUint64(e[40:], uint64(part.start+part.sectors-1))
+		for j, unit := range utf16.Encode([]rune(part.name)) {
+			if j == 36 {
+				break
+			}
+			le.PutUint16(e[56+j*2:], unit)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	last := l.sectors - 1
+	header := func(current, backup, entriesLBA int64) []byte {
+		h := make([]byte, 512)
+		copy(h[0:], gptMagic)
+		le.PutUint32(h[8:], 0x00010000)
+		le.PutUint32(h[12:], 92)
+		le.PutUint64(h[24:], uint64(current))
+		le.PutUint64(h[32:], uint64(backup))
+		le.PutUint64(h[40:], uint64(2+gptEntriesSectors))
+		le.PutUint64(h[48:], uint64(last-gptEntriesSectors-1))
+		guid := deriveGUID(l.key + "|disk")
+		copy(h[56:], guid[:])
+		le.PutUint64(h[72:], uint64(entriesLBA))
+		le.PutUint32(h[80:], gptEntries)
+		le.PutUint32(h[84:], gptEntrySize)
+		le.PutUint32(h[88:], entriesCRC)
+		le.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+
+	copy(head[512:], header(1, last, 2))
+	copy(head[1024:], entries)
+
+	tail := make([]byte, (gptEntriesSectors+1)*512)
+	copy(tail, entries)
+	copy(tail[gptEntriesSectors*512:], header(last, 1, last-gptEntriesSectors))
+	return head, tail
+}
+
+// mbrEntry fills a partition table entry addressed by LBA only
+func mbrEntry(e []byte, partType byte, start, sectors int64) {
+	copy(e[1:4], []byte{0xfe, 0xff, 0xff})
+	e[4] = partType
+	copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:], uint32(start))
+	binary.LittleEndian.PutUint32(e[12:], uint32(sectors))
+}
+
+// attachCompose writes the partition table, attaches every component to a
+// loop device and joins them into one disk with device-mapper. Gaps left
+// by alignment read as zeros.
+func attachCompose(l *composeLayout, readOnly bool) (string, error) {
+	if !dmSupported() {
+		return "", fmt.Errorf("device-mapper not available\nHint: --compose needs a kernel with device-mapper support")
+	}
+
+	dir := filepath.Join(stateDir, "compose")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("create compose dir: %w", err)
+	}
+
+	for _, part := range l.parts {
+		if !part.scratch {
+			continue
+		}
+		file, err := os.OpenFile(part.path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return "", fmt.Errorf("create scratch partition: %w", err)
+		}
+		err = file.Truncate(part.sectors * 512)
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("create scratch partition: %w", err)
+		}
+	}
+
+	head, tail := l.headers()
+	headPath := filepath.Join(dir, l.key+"-head.img")
+	if err := os.WriteFile(headPath, head, 0600); err != nil {
+		return "", fmt.Errorf("write partition table: %w", err)
+	}
+
+	attach := func(path string) (string, error) {
+		loop, err := attachLoop(path, 0, 0, readOnly)
+		if err != nil {
+			return "", fmt.Errorf("attach %s: %w", filepath.Base(path), err)
+		}
+		if err := recordLoop(loop); err != nil {
+			logger.Warn("Failed to record loop device in state", "error", err)
+		}
+		return loop.Device, nil
+	}
+
+	device, err := attach(headPath)
+	if err != nil {
+		return "", err
+	}
+	table := []dmTarget{{Start: 0, Length: composeAlign, Type: "linear", Params: device + " 0"}}
+	end := int64(composeAlign)
+	var files []string
+	for _, part := range l.parts {
+		if part.start > end {
+			table = append(table, dmTarget{Start: end, Length: part.start - end, Type: "zero"})
+		}
+		if device, err = attach(part.path); err != nil {
+			return "", err
+		}
+		table = append(table, dmTarget{Start: part.start, Length: part.sectors, Type: "linear", Params: device + " 0"})
+		end = part.start + part.sectors
+		files = append(files, part.path)
+	}
+
+	if tail != nil {
+		tailStart := l.sectors - int64(len(tail)/512)
+		if tailStart > end {
+			table = append(table, dmTarget{Start: end, Length: tailStart - end, Type: "zero"})
+		}
+		tailPath := filepath.Join(dir, l.key+"-tail.img")
+		if err := os.WriteFile(tailPath, tail, 0600); err != nil {
+			return "", fmt.Errorf("write backup partition table: %w", err)
+		}
+		if device, err = attach(tailPath); err != nil {
+			return "", err
+		}
+		table = append(table, dmTarget{Start: tailStart, Length: int64(len(tail) / 512), Type: "linear", Params: device + " 0"})
+	}
+
+	name := l.name()
+	disk, err := dmCreate(name, table, readOnly)
+	if err != nil {
+		return "", fmt.Errorf("compose disk: %w", err)
+	}
+
+	state, err := loadState()
+	if err == nil {
+		state.Mappings = append(state.Mappings, Mapping{Name: name, Device: disk, Parts: files, Compose: l.spec})
+		err = state.save()
+	}
+	if err != nil {
+		dmRemove(name)
+		return "", err
+	}
+	return disk, nil
+}
+
+// name is the device-mapper name of the composed disk
+func (l *composeLayout) name() string {
+	return "usbdrive-compose-" + l.key
+}
+
+// printLayout shows the partitions of a composed disk
+func (l *composeLayout) printLayout() {
+	table := "MBR"
+	if l.gpt {
+		table = "GPT"
+	}
+	fmt.Printf("%s disk, %s\n", table, formatSize(l.sectors*512))
+	for i, part := range l.parts {
+		source := part.path
+		if part.scratch {
+			source = "scratch"
+		}
+		fmt.Printf("  %d: sectors %d-%d, %s, %s", i+1, part.start, part.start+part.sectors-1, formatSize(part.sectors*512), source)
+		if part.name != "" {
+			fmt.Printf(" (%s)", part.name)
+		}
+		fmt.Println()
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compression describes a compressed container format
+type compression struct {
+	name   string
+	ext    string
+	magic  []byte
+	reader func(io.Reader) (io.Reader, func(), error)
+}
+
+var compressions = []compression{
+	{
+		name:  "gzip",
+		ext:   ".gz",
+		magic: []byte{0x1f, 0x8b},
+		reader: func(r io.Reader) (io.Reader, func(), error) {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			return zr, func() { zr.Close() }, nil
+		},
+	},
+	{
+		name:  "xz",
+		ext:   ".xz",
+		magic: []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		reader: func(r io.Reader) (io.Reader, func(), error) {
+			zr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			return zr, func() {}, nil
+		},
+	},
+	{
+		name:  "zstd",
+		ext:   ".zst",
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		reader: func(r io.Reader) (io.Reader, func(), error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			return zr, zr.Close, nil
+		},
+	},
+	{
+		name:  "bzip2",
+		ext:   ".bz2",
+		magic: []byte{'B', 'Z', 'h'},
+		reader: func(r io.Reader) (io.Reader, func(), error) {
+			return bzip2.NewReader(r), func() {}, nil
+		},
+	},
+}
+
+// detectCompression returns the compression format of path by its magic
+// bytes, or nil if the file is not compressed.
+func detectCompression(path string) (*compression, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 8)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	header = header[:n]
+
+	for i := range compressions {
+		if bytes.HasPrefix(header, compressions[i].magic) {
+			return &compressions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// decompressImage decompresses a compressed image into the image cache and
+// returns the path of the raw copy. An existing cached copy is reused.
+func decompressImage(path string, comp *compression, cacheLimit int64) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(path)
+	if strings.EqualFold(filepath.Ext(name), comp.ext) {
+		name = name[:len(name)-len(comp.ext)]
+	}
+	target := cachePath(path, info, name)
+
+	if cacheLookup(target) {
+		logger.Info("Using cached decompressed image", "path", target)
+		return target, nil
+	}
+
+	logger.Info("Decompressing image", "format", comp.name, "source", path, "target", target)
+	err = cacheCreate(target, func(out *os.File) error {
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		progress := newProgress("Decompressing "+comp.name, info.Size())
+		zr, closeReader, err := comp.reader(bufio.NewReader(io.TeeReader(in, progress)))
+		if err != nil {
+			return fmt.Errorf("open %s stream: %w", comp.name, err)
+		}
+		defer closeReader()
+
+		written, err := copySparse(out, zr)
+		progress.Done()
+		if err != nil {
+			return fmt.Errorf("decompress %s: %w", comp.name, err)
+		}
+		if written == 0 {
+			return fmt.Errorf("decompressed image is empty")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := evictCache(cacheLimit, target); err != nil {
+		logger.Warn("Failed to evict cached images", "error", err)
+	}
+
+	return target, nil
+}
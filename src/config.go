@@ -1,52 +1,701 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type Config struct {
-	File    string `json:"file"`
-	Mode    string `json:"mode,omitempty"`    // "ro", "rw", "cdrom"
-	Backend string `json:"backend,omitempty"` // "configfs", "sysfs", "udc"
+// defaultConfigPath is the config the Magisk module mounts on boot
+const defaultConfigPath = "/data/adb/modules/usbdrive/usbdrive.json"
+
+// configPath returns the config file named by a flag, then by
+// USBDRIVE_CONFIG, then the default
+func configPath(flag string) string {
+	if flag != "" {
+		return flag
+	}
+	if path := os.Getenv("USBDRIVE_CONFIG"); path != "" {
+		return path
+	}
+	return defaultConfigPath
+}
+
+// configVersion is the current config schema. Files without a version are
+// version 1 (a single file, mode and backend per profile) and are migrated
+// when read.
+const configVersion = 2
+
+// maxLUNs is the number of LUNs the mass storage function supports
+const maxLUNs = 16
+
+// ConfigFile holds named profiles and the one mounted by default
+type ConfigFile struct {
+	Version  int                 `json:"version"`
+	Default  string              `json:"default,omitempty"`
+	Profiles map[string]*Profile `json:"profiles"`
+
+	migrated bool              // read from a version 1 file
+	paths    map[string]string // JSON path of each profile
+}
+
+// Profile is one mount setup: the images and how the gadget exposes them
+type Profile struct {
+	Backend string        `json:"backend,omitempty"` // "configfs", "sysfs", "udc"
+	UDC     string        `json:"udc,omitempty"`     // controller to bind, e.g. "a600000.dwc3"
+	Gadget  *GadgetConfig `json:"gadget,omitempty"`
+	Wait    string        `json:"wait,omitempty"` // how long mount waits for images and the gadget, e.g. "30s"
+	Hooks   *Hooks        `json:"hooks,omitempty"`
+	LUNs    []LUNConfig   `json:"luns"`
+
+	name     string // set when read from a file
+	path     string // JSON path in the file
+	migrated bool   // read from a version 1 file
+	wait     time.Duration
 }
 
-func loadConfig(path string) (*Config, error) {
+// LUNConfig is one image of a profile
+type LUNConfig struct {
+	File string `json:"file"`
+	Mode string `json:"mode,omitempty"` // "auto" (default), "ro", "rw", "cdrom"
+	LUNAttributes
+}
+
+// mode returns the mode of the LUN, auto-detected unless set
+func (l *LUNConfig) mode() string {
+	if l.Mode == "" {
+		return "auto"
+	}
+	return l.Mode
+}
+
+// GadgetConfig overrides USB descriptors of the gadget while mounted
+type GadgetConfig struct {
+	VendorID     string `json:"vendor_id,omitempty"`
+	ProductID    string `json:"product_id,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	Serial       string `json:"serial,omitempty"`
+}
+
+// gadgetFields maps descriptor settings to their configfs attributes
+var gadgetFields = []struct {
+	key   string
+	file  string
+	id    bool
+	value func(*GadgetConfig) *string
+}{
+	{"vendor_id", "idVendor", true, func(g *GadgetConfig) *string { return &g.VendorID }},
+	{"product_id", "idProduct", true, func(g *GadgetConfig) *string { return &g.ProductID }},
+	{"manufacturer", "strings/0x409/manufacturer", false, func(g *GadgetConfig) *string { return &g.Manufacturer }},
+	{"product", "strings/0x409/product", false, func(g *GadgetConfig) *string { return &g.Product }},
+	{"serial", "strings/0x409/serialnumber", false, func(g *GadgetConfig) *string { return &g.Serial }},
+}
+
+// Hooks are shell commands run around a mount
+type Hooks struct {
+	PreMount    string `json:"pre_mount,omitempty"`
+	PostMount   string `json:"post_mount,omitempty"`
+	PostUnmount string `json:"post_unmount,omitempty"`
+}
+
+// sourcePath returns the JSON path of a setting of the profile, e.g.
+// "profiles.ubuntu.luns[0].mode"
+func (p *Profile) sourcePath(key string) string {
+	if p.migrated {
+		// Version 1 profiles have the settings of their LUN at the top
+		key = strings.TrimPrefix(key, "luns[0].")
+	}
+	if p.path == "" {
+		return key
+	}
+	return p.path + "." + key
+}
+
+// source names where a setting of the profile comes from
+func (p *Profile) source(key string) string {
+	return "config " + p.sourcePath(key)
+}
+
+// needsConfigFS reports whether the profile uses features only the configfs
+// backend has
+func (p *Profile) needsConfigFS() bool {
+	if len(p.LUNs) > 1 || p.Gadget != nil || p.UDC != "" {
+		return true
+	}
+	for _, lun := range p.LUNs {
+		if lun.LUNAttributes != (LUNAttributes{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareLUN checks an image mounted as a further LUN of a profile and
+// returns its mode. Unlike the first LUN it is exposed as it is, without
+// conversion or loop devices.
+func prepareLUN(lun LUNConfig, pad, force, dryRun bool) (string, error) {
+	if err := validateImage(lun.File); err != nil {
+		return "", fmt.Errorf("invalid image file: %w", err)
+	}
+	if comp, err := detectCompression(lun.File); err != nil {
+		return "", err
+	} else if comp != nil {
+		return "", fmt.Errorf("%s is %s compressed\nHint: Only the first LUN of a profile is decompressed, decompress it manually", lun.File, comp.name)
+	}
+	if format, err := detectDiskFormat(lun.File); err != nil {
+		return "", err
+	} else if format != nil {
+		return "", fmt.Errorf("%s is a %s virtual disk\nHint: Only the first LUN of a profile is converted, use 'usbdrive convert'", lun.File, format.name)
+	}
+
+	mode := lun.mode()
+	if mode == "auto" {
+		detected, reason, err := detectMode(lun.File, 0)
+		if err != nil {
+			return "", fmt.Errorf("detect mode: %w", err)
+		}
+		logger.Info("Selected mode automatically", "file", lun.File, "mode", detected, "reason", reason)
+		mode = detected
+	}
+	if err := checkBusy([]string{lun.File}, mode == "rw", force); err != nil {
+		return "", err
+	}
+	if err := fitImageSize(lun.File, mode == "cdrom", pad, dryRun); err != nil {
+		return "", fmt.Errorf("invalid image size: %w", err)
+	}
+	return mode, nil
+}
+
+// configProblem is an invalid value of a config file and where it is
+type configProblem struct {
+	Path    string
+	Message string
+}
+
+func (p configProblem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// configError lists every problem found in a config file
+type configError struct {
+	File     string
+	Problems []configProblem
+}
+
+func (e *configError) Error() string {
+	if len(e.Problems) == 1 {
+		return fmt.Sprintf("%s: %s", e.File, e.Problems[0])
+	}
+	lines := []string{fmt.Sprintf("%s has %d problems:", e.File, len(e.Problems))}
+	for _, problem := range e.Problems {
+		lines = append(lines, "  "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readConfigFile parses and validates a config file
+func readConfigFile(path string) (*ConfigFile, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("read config file: %w", err)
 	}
+	file, problems := parseConfig(data)
+	if len(problems) > 0 {
+		return nil, &configError{File: path, Problems: problems}
+	}
+	if file.migrated {
+		logger.Info("Migrated version 1 config", "path", path)
+	}
+	return file, nil
+}
+
+// parseConfig reads a config of any version. The returned file is nil only
+// if the JSON itself is broken; otherwise it holds whatever could be read
+// next to the problems found.
+func parseConfig(data []byte) (*ConfigFile, []configProblem) {
+	root, err := decodeJSON(data)
+	if err != nil {
+		return nil, []configProblem{{Message: jsonErrorLocation(data, err)}}
+	}
+
+	r := &configReader{}
+	file := r.file(root)
+	return file, r.problems
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers as json.Number
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var root any
+	err := decoder.Decode(&root)
+	if err == nil {
+		if _, extra := decoder.Token(); extra != io.EOF {
+			err = fmt.Errorf("unexpected data after the top-level value")
+		}
+	}
+	return root, err
+}
+
+// jsonErrorLocation adds the line and column to JSON syntax errors
+func jsonErrorLocation(data []byte, err error) string {
+	var offset int64
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		offset = syntax.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		offset = int64(len(data))
+	default:
+		return err.Error()
+	}
+	before := data[:min(int(offset), len(data))]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d: %v", line, column, err)
+}
+
+// configReader turns the decoded JSON of a config file into profiles,
+// recording each invalid value with its JSON path instead of stopping
+type configReader struct {
+	problems []configProblem
+}
+
+func (r *configReader) fail(path, format string, args ...any) {
+	r.problems = append(r.problems, configProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+var plainKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// joinPath appends an object key to a JSON path
+func joinPath(path, key string) string {
+	if !plainKey.MatchString(key) {
+		return path + "[" + strconv.Quote(key) + "]"
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonType names the JSON type of a decoded value for error messages
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	case string:
+		return "a string"
+	case []any:
+		return "an array"
+	}
+	return "an object"
+}
+
+// object returns value as an object, reporting fields not in keys unless
+// no keys are given
+func (r *configReader) object(value any, path string, keys ...string) map[string]any {
+	obj, ok := value.(map[string]any)
+	if !ok {
+		r.fail(path, "expected an object, got %s", jsonType(value))
+		return nil
+	}
+	if keys == nil {
+		return obj
+	}
+	var unknown []string
+	for key := range obj {
+		if !slices.Contains(keys, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		r.fail(joinPath(path, key), "unknown field (expected one of %s)", strings.Join(keys, ", "))
+	}
+	return obj
+}
+
+// str returns a string field, or "" if it is missing or null
+func (r *configReader) str(obj map[string]any, path, key string) string {
+	value := obj[key]
+	if value == nil {
+		return ""
+	}
+	s, ok := value.(string)
+	if !ok {
+		r.fail(joinPath(path, key), "expected a string, got %s", jsonType(value))
+	}
+	return s
+}
+
+// boolean returns a boolean field, or nil if it is missing or null
+func (r *configReader) boolean(obj map[string]any, path, key string) *bool {
+	value := obj[key]
+	if value == nil {
+		return nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		r.fail(joinPath(path, key), "expected true or false, got %s", jsonType(value))
+		return nil
+	}
+	return &b
+}
 
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("parse config file: %w", err)
+// file reads the top level of a config file of any version
+func (r *configReader) file(root any) *ConfigFile {
+	obj, ok := root.(map[string]any)
+	if !ok {
+		r.fail("", "expected an object, got %s", jsonType(root))
+		return nil
 	}
 
-	// Validate required fields
-	if cfg.File == "" {
-		return nil, fmt.Errorf("config missing required field: file")
+	version := 1
+	if value, ok := obj["version"]; ok {
+		number, isNumber := value.(json.Number)
+		n, err := strconv.Atoi(string(number))
+		if !isNumber || err != nil {
+			r.fail("version", "expected an integer, got %s", jsonType(value))
+			return nil
+		}
+		version = n
 	}
 
-	// Resolve to absolute path
-	if !filepath.IsAbs(cfg.File) {
-		absPath, err := filepath.Abs(cfg.File)
+	file := &ConfigFile{Version: configVersion, Profiles: map[string]*Profile{}, paths: map[string]string{}}
+	switch version {
+	case 1:
+		r.object(obj, "", "version", "default", "profiles", "file", "mode", "backend")
+		file.migrated = true
+		if obj["profiles"] == nil {
+			// A flat config is a single profile
+			if obj["default"] != nil {
+				r.fail("default", "set but there are no profiles")
+			}
+			file.Profiles["default"] = r.profileV1(obj, "")
+			file.Profiles["default"].name = "default"
+			file.paths["default"] = ""
+			return file
+		}
+		for _, key := range []string{"file", "mode", "backend"} {
+			if obj[key] != nil {
+				r.fail(key, "top-level settings cannot be mixed with profiles, move them into a profile")
+			}
+		}
+	case 2:
+		r.object(obj, "", "version", "default", "profiles")
+		if obj["profiles"] == nil {
+			r.fail("profiles", "missing required field")
+			return file
+		}
+	default:
+		r.fail("version", "unsupported version %d (must be 1 or %d)", version, configVersion)
+		return nil
+	}
+
+	profiles := r.object(obj["profiles"], "profiles")
+	if profiles != nil && len(profiles) == 0 {
+		r.fail("profiles", "no profiles defined")
+	}
+	for _, name := range sortedKeys(profiles) {
+		value := profiles[name]
+		path := joinPath("profiles", name)
+		if name == "" {
+			r.fail(path, "profile name is empty")
+		}
+		var profile *Profile
+		if version == 1 {
+			if profileObj := r.object(value, path, "file", "mode", "backend"); profileObj != nil {
+				profile = r.profileV1(profileObj, path)
+			}
+		} else {
+			profile = r.profile(value, path)
+		}
+		if profile != nil {
+			profile.name = name
+			profile.path = path
+			file.Profiles[name] = profile
+			file.paths[name] = path
+		}
+	}
+
+	file.Default = r.str(obj, "", "default")
+	if file.Default != "" && profiles != nil && profiles[file.Default] == nil {
+		r.fail("default", "no profile named %s (available: %s)", file.Default, strings.Join(sortedKeys(profiles), ", "))
+	}
+	return file
+}
+
+// profileV1 migrates a version 1 profile to a single LUN
+func (r *configReader) profileV1(obj map[string]any, path string) *Profile {
+	lun := LUNConfig{
+		File: r.str(obj, path, "file"),
+		Mode: r.str(obj, path, "mode"),
+	}
+	r.lunFile(&lun, obj, path)
+	r.lunMode(&lun, path)
+	profile := &Profile{Backend: r.str(obj, path, "backend"), LUNs: []LUNConfig{lun}, migrated: true}
+	r.backend(profile.Backend, joinPath(path, "backend"))
+	return profile
+}
+
+// profile reads a version 2 profile
+func (r *configReader) profile(value any, path string) *Profile {
+	obj := r.object(value, path, "backend", "udc", "gadget", "wait", "hooks", "luns")
+	if obj == nil {
+		return nil
+	}
+	profile := &Profile{
+		Backend: r.str(obj, path, "backend"),
+		UDC:     r.str(obj, path, "udc"),
+		Wait:    r.str(obj, path, "wait"),
+	}
+	r.backend(profile.Backend, joinPath(path, "backend"))
+	if strings.ContainsAny(profile.UDC, "/ ") {
+		r.fail(joinPath(path, "udc"), "invalid controller name %q (see /sys/class/udc)", profile.UDC)
+	}
+	if profile.Wait != "" {
+		wait, err := time.ParseDuration(profile.Wait)
+		if err != nil || wait < 0 {
+			r.fail(joinPath(path, "wait"), "invalid duration %q (e.g. 30s or 2m)", profile.Wait)
+		}
+		profile.wait = wait
+	}
+	if obj["gadget"] != nil {
+		profile.Gadget = r.gadget(obj["gadget"], joinPath(path, "gadget"))
+	}
+	if obj["hooks"] != nil {
+		hooksPath := joinPath(path, "hooks")
+		if hooks := r.object(obj["hooks"], hooksPath, "pre_mount", "post_mount", "post_unmount"); hooks != nil {
+			profile.Hooks = &Hooks{
+				PreMount:    r.str(hooks, hooksPath, "pre_mount"),
+				PostMount:   r.str(hooks, hooksPath, "post_mount"),
+				PostUnmount: r.str(hooks, hooksPath, "post_unmount"),
+			}
+		}
+	}
+
+	lunsPath := joinPath(path, "luns")
+	luns, ok := obj["luns"].([]any)
+	switch {
+	case obj["luns"] == nil:
+		r.fail(lunsPath, "missing required field")
+	case !ok:
+		r.fail(lunsPath, "expected an array, got %s", jsonType(obj["luns"]))
+	case len(luns) == 0:
+		r.fail(lunsPath, "at least one LUN is required")
+	case len(luns) > maxLUNs:
+		r.fail(lunsPath, "%d LUNs, the mass storage function supports at most %d", len(luns), maxLUNs)
+	}
+	for i, value := range luns {
+		lunPath := fmt.Sprintf("%s[%d]", lunsPath, i)
+		lunObj := r.object(value, lunPath, "file", "mode", "removable", "nofua", "inquiry")
+		if lunObj == nil {
+			continue
+		}
+		lun := LUNConfig{
+			File: r.str(lunObj, lunPath, "file"),
+			Mode: r.str(lunObj, lunPath, "mode"),
+			LUNAttributes: LUNAttributes{
+				Removable: r.boolean(lunObj, lunPath, "removable"),
+				NoFUA:     r.boolean(lunObj, lunPath, "nofua"),
+				Inquiry:   r.str(lunObj, lunPath, "inquiry"),
+			},
+		}
+		r.lunFile(&lun, lunObj, lunPath)
+		r.lunMode(&lun, lunPath)
+		r.inquiry(lun.Inquiry, joinPath(lunPath, "inquiry"))
+		profile.LUNs = append(profile.LUNs, lun)
+	}
+
+	if profile.Backend != "" && profile.Backend != "configfs" && profile.needsConfigFS() {
+		r.fail(joinPath(path, "backend"), "%s supports a single LUN without gadget settings or LUN attributes, use configfs", profile.Backend)
+	}
+	return profile
+}
+
+// lunFile checks the image path of a LUN and makes it absolute
+func (r *configReader) lunFile(lun *LUNConfig, obj map[string]any, path string) {
+	if obj["file"] == nil {
+		r.fail(joinPath(path, "file"), "missing required field")
+		return
+	}
+	if lun.File == "" {
+		r.fail(joinPath(path, "file"), "must not be empty")
+		return
+	}
+	// Volume references and variables are resolved at mount time, when
+	// removable storage may have shown up
+	if !isPathRef(lun.File) && !filepath.IsAbs(lun.File) {
+		absPath, err := filepath.Abs(lun.File)
 		if err != nil {
-			return nil, fmt.Errorf("resolve absolute path for '%s': %w", cfg.File, err)
+			r.fail(joinPath(path, "file"), "resolve absolute path: %v", err)
+			return
 		}
-		cfg.File = absPath
+		lun.File = absPath
 	}
+}
+
+// lunMode checks the mode of a LUN
+func (r *configReader) lunMode(lun *LUNConfig, path string) {
+	if lun.Mode != "" && !validMode(lun.Mode) {
+		r.fail(joinPath(path, "mode"), "invalid mode %q (must be auto, ro, rw, or cdrom)", lun.Mode)
+	}
+}
+
+// inquiry checks a SCSI inquiry string
+func (r *configReader) inquiry(inquiry, path string) {
+	if err := validateInquiry(inquiry); err != nil {
+		r.fail(path, "%v", err)
+	}
+}
+
+// validateInquiry checks that a SCSI inquiry string fits its 28 bytes
+func validateInquiry(inquiry string) error {
+	if len(inquiry) > 28 || strings.IndexFunc(inquiry, func(c rune) bool { return c < ' ' || c > '~' }) >= 0 {
+		return fmt.Errorf("must be at most 28 printable ASCII characters (vendor 8, product 16, revision 4)")
+	}
+	return nil
+}
+
+func (r *configReader) backend(backend, path string) {
+	if backend != "" && backend != "configfs" && backend != "sysfs" && backend != "udc" {
+		r.fail(path, "invalid backend %q (must be configfs, sysfs, or udc)", backend)
+	}
+}
+
+// gadget reads the descriptor overrides of a profile
+func (r *configReader) gadget(value any, path string) *GadgetConfig {
+	obj := r.object(value, path, "vendor_id", "product_id", "manufacturer", "product", "serial")
+	if obj == nil {
+		return nil
+	}
+	gadget := &GadgetConfig{
+		VendorID:     r.str(obj, path, "vendor_id"),
+		ProductID:    r.str(obj, path, "product_id"),
+		Manufacturer: r.str(obj, path, "manufacturer"),
+		Product:      r.str(obj, path, "product"),
+		Serial:       r.str(obj, path, "serial"),
+	}
+	for _, field := range gadgetFields {
+		value := field.value(gadget)
+		switch {
+		case *value == "":
+		case field.id:
+			hex, ok := strings.CutPrefix(strings.ToLower(*value), "0x")
+			n, err := strconv.ParseUint(hex, 16, 16)
+			if !ok || err != nil {
+				r.fail(joinPath(path, field.key), "invalid USB ID %q (must be hexadecimal, e.g. 0x1d6b)", *value)
+				continue
+			}
+			*value = fmt.Sprintf("0x%04x", n)
+		case len(*value) > 126:
+			// USB string descriptors hold 126 UTF-16 code units
+			r.fail(joinPath(path, field.key), "longer than 126 characters")
+		}
+	}
+	if *gadget == (GadgetConfig{}) {
+		return nil
+	}
+	return gadget
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// names returns the profile names in sorted order
+func (f *ConfigFile) names() []string {
+	return sortedKeys(f.Profiles)
+}
 
-	// Validate mode if specified
-	if cfg.Mode != "" && cfg.Mode != "ro" && cfg.Mode != "rw" && cfg.Mode != "cdrom" {
-		return nil, fmt.Errorf("invalid mode: %s (must be ro, rw, or cdrom)", cfg.Mode)
+// defaultName returns the profile used when none is named: the default,
+// or the only profile of the file
+func (f *ConfigFile) defaultName() string {
+	if f.Default != "" {
+		return f.Default
 	}
+	if len(f.Profiles) == 1 {
+		return f.names()[0]
+	}
+	return ""
+}
 
-	// Validate backend if specified
-	if cfg.Backend != "" && cfg.Backend != "configfs" && cfg.Backend != "sysfs" && cfg.Backend != "udc" {
-		return nil, fmt.Errorf("invalid backend: %s (must be configfs, sysfs, or udc)", cfg.Backend)
+// profile returns the named profile, or the default one if name is empty
+func (f *ConfigFile) profile(name string) (*Profile, error) {
+	if name == "" {
+		if name = f.defaultName(); name == "" {
+			return nil, fmt.Errorf("config has no default profile (available: %s)\nHint: Set \"default\" in the config or pick a profile with -p", strings.Join(f.names(), ", "))
+		}
+	}
+	profile := f.Profiles[name]
+	if profile == nil {
+		return nil, fmt.Errorf("no profile named %s (available: %s)", name, strings.Join(f.names(), ", "))
+	}
+	return profile, nil
+}
+
+// owner returns the profile a problem is located in, if any
+func (f *ConfigFile) owner(problem configProblem) string {
+	for name, path := range f.paths {
+		if path == "" || problem.Path == path || strings.HasPrefix(problem.Path, path+".") || strings.HasPrefix(problem.Path, path+"[") {
+			return name
+		}
 	}
+	return ""
+}
 
-	return &cfg, nil
+// loadConfig reads a config file and returns the named profile, or the
+// default one if name is empty. Problems in other profiles don't keep this
+// one from mounting.
+func loadConfig(path, name string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	file, problems := parseConfig(data)
+	if file == nil {
+		return nil, &configError{File: path, Problems: problems}
+	}
+	if name == "" {
+		name = file.defaultName()
+	}
+	var relevant []configProblem
+	for _, problem := range problems {
+		if owner := file.owner(problem); owner == "" || owner == name {
+			relevant = append(relevant, problem)
+		}
+	}
+	if len(relevant) > 0 {
+		return nil, &configError{File: path, Problems: relevant}
+	}
+	if file.migrated {
+		logger.Info("Migrated version 1 config", "path", path)
+	}
+	return file.profile(name)
 }
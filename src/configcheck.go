@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkConfig runs every check on a config file, from its syntax to whether
+// each profile can be mounted on this device, and returns all problems
+func checkConfig(data []byte) []configProblem {
+	file, problems := parseConfig(data)
+	if file == nil {
+		return problems
+	}
+	problems = append(problems, duplicateKeys(data)...)
+
+	backends := []Backend{&ConfigFSBackend{}, &UDCBackend{}, &SysfsBackend{}}
+	supported := map[string]bool{}
+	var auto string
+	for _, backend := range backends {
+		if backend.Supported() {
+			supported[backend.Name()] = true
+			if auto == "" {
+				auto = backend.Name()
+			}
+		}
+	}
+	if auto == "" {
+		problems = append(problems, configProblem{Message: "no USB gadget backend is supported on this device"})
+	}
+
+	for _, name := range file.names() {
+		profile := file.Profiles[name]
+		backend := profile.Backend
+		switch {
+		case backend == "":
+			backend = auto
+		case !supported[backend]:
+			problems = append(problems, configProblem{profile.sourcePath("backend"), fmt.Sprintf("%s is not supported on this device", backend)})
+		}
+		if profile.Backend == "" && backend != "" && backend != "configfs" && profile.needsConfigFS() {
+			problems = append(problems, configProblem{profile.sourcePath("backend"), fmt.Sprintf("%s would be selected on this device, but the profile needs configfs (multiple LUNs, gadget settings or LUN attributes)", backend)})
+		}
+		if profile.UDC != "" && !dirExists(filepath.Join("/sys/class/udc", profile.UDC)) {
+			problems = append(problems, configProblem{profile.sourcePath("udc"), fmt.Sprintf("no controller %s in /sys/class/udc", profile.UDC)})
+		}
+
+		for i, lun := range profile.LUNs {
+			lunPath := func(key string) string {
+				return profile.sourcePath(fmt.Sprintf("luns[%d].%s", i, key))
+			}
+			if lun.File == "" {
+				continue
+			}
+			file, err := resolvePath(lun.File)
+			if err != nil {
+				message, _, _ := strings.Cut(err.Error(), "\n")
+				problems = append(problems, configProblem{lunPath("file"), message})
+			} else if !isBlockDevice(file) {
+				if err := validateImage(file); err != nil {
+					problems = append(problems, configProblem{lunPath("file"), err.Error()})
+				}
+			}
+			for j, other := range profile.LUNs[:i] {
+				if sameImage(lun.File, other.File) {
+					problems = append(problems, configProblem{lunPath("file"), fmt.Sprintf("same image as LUN %d, the host would see one disk twice", j)})
+				}
+			}
+
+			mode := lun.mode()
+			switch {
+			case backend == "sysfs" && (mode == "rw" || mode == "cdrom"):
+				problems = append(problems, configProblem{lunPath("mode"), fmt.Sprintf("%s is not supported by sysfs, which only mounts read-only", mode)})
+			case backend == "udc" && (mode == "ro" || mode == "cdrom"):
+				problems = append(problems, configProblem{lunPath("mode"), fmt.Sprintf("%s is not supported by udc, which only mounts read-write", mode)})
+			}
+		}
+	}
+	return problems
+}
+
+// sameImage reports whether two paths or path references name the same image
+func sameImage(a, b string) bool {
+	if a == b {
+		return true
+	}
+	a, errA := resolvePath(a)
+	b, errB := resolvePath(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && sameFile(infoA, infoB)
+}
+
+// duplicateKeys finds object keys given twice, of which JSON decoding
+// silently keeps the last
+func duplicateKeys(data []byte) []configProblem {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var problems []configProblem
+	var walk func(path string) error
+	walk = func(path string) error {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'):
+			seen := map[string]bool{}
+			for decoder.More() {
+				token, err := decoder.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := token.(string)
+				keyPath := joinPath(path, key)
+				if seen[key] {
+					problems = append(problems, configProblem{keyPath, "duplicate key, only the last one is used"})
+				}
+				seen[key] = true
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; decoder.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		// The closing delimiter
+		_, err = decoder.Token()
+		return err
+	}
+	walk("")
+	return problems
+}
@@ -6,7 +6,10 @@ import (
 	"path/filepath"
 )
 
-type ConfigFSBackend struct{}
+type ConfigFSBackend struct {
+	Gadget *GadgetConfig // descriptors to set while mounted
+	UDC    string        // controller to bind instead of the current one
+}
 
 func (c *ConfigFSBackend) Name() string {
 	return "configfs"
@@ -22,6 +25,12 @@ func (c *ConfigFSBackend) Supported() bool {
 }
 
 func (c *ConfigFSBackend) Mount(imagePath string, opts MountOptions) error {
+	return c.MountLUNs([]LUN{{File: imagePath, MountOptions: opts}})
+}
+
+// MountLUNs exposes each image as its own LUN of the mass storage function,
+// so the host sees several drives at once
+func (c *ConfigFSBackend) MountLUNs(luns []LUN) error {
 	gadgetRoot, err := c.findGadgetRoot()
 	if err != nil {
 		return fmt.Errorf("find gadget: %w", err)
@@ -53,9 +62,20 @@ func (c *ConfigFSBackend) Mount(imagePath string, opts MountOptions) error {
 		}
 	}()
 
+	if c.UDC != "" && c.UDC != udc {
+		if !dirExists(filepath.Join("/sys/class/udc", c.UDC)) {
+			return fmt.Errorf("UDC %s not found in /sys/class/udc", c.UDC)
+		}
+		logger.Info("Switching UDC controller", "udc", c.UDC)
+		udc = c.UDC
+	}
+
+	if err := applyDescriptors(gadgetRoot, c.Gadget); err != nil {
+		return fmt.Errorf("gadget descriptors: %w", err)
+	}
+
 	functionRoot := filepath.Join(gadgetRoot, "functions")
 	massStorageRoot := filepath.Join(functionRoot, "mass_storage.0")
-	lunRoot := filepath.Join(massStorageRoot, "lun.0")
 
 	// Create mass storage function if needed
 	if !dirExists(massStorageRoot) {
@@ -74,48 +94,88 @@ func (c *ConfigFSBackend) Mount(imagePath string, opts MountOptions) error {
 		}
 	}
 
-	// Clear existing file
-	lunFile := filepath.Join(lunRoot, "file")
-	if err := writeFile(lunFile, ""); err != nil {
-		return fmt.Errorf("clear lun file: %w", err)
+	// Drop LUNs left over from a previous multi-LUN mount
+	if err := c.removeExtraLUNs(massStorageRoot, len(luns)); err != nil {
+		return err
 	}
 
-	// Set CDROM flag
-	cdromValue := "0"
-	if opts.CDROM {
-		cdromValue = "1"
-	}
-	logger.Info("Setting CDROM flag", "value", cdromValue)
-	if err := writeFile(filepath.Join(lunRoot, "cdrom"), cdromValue); err != nil {
-		return fmt.Errorf("set cdrom flag: %w", err)
-	}
+	for i, lun := range luns {
+		lunRoot := filepath.Join(massStorageRoot, fmt.Sprintf("lun.%d", i))
+		if !dirExists(lunRoot) {
+			logger.Info("Creating LUN", "lun", i)
+			if err := os.Mkdir(lunRoot, 0755); err != nil {
+				return fmt.Errorf("create lun.%d: %w", i, err)
+			}
+		}
 
-	// Set read-only flag
-	roValue := "1"
-	if opts.ReadWrite {
-		roValue = "0"
-	}
-	logger.Info("Setting read-only flag", "value", roValue)
-	if err := writeFile(filepath.Join(lunRoot, "ro"), roValue); err != nil {
-		return fmt.Errorf("set ro flag: %w", err)
-	}
+		// Clear existing file
+		lunFile := filepath.Join(lunRoot, "file")
+		if err := writeFile(lunFile, ""); err != nil {
+			return fmt.Errorf("clear lun file: %w", err)
+		}
 
-	// Mount the image
-	logger.Info("Writing image path to LUN")
-	if err := writeFile(lunFile, imagePath); err != nil {
-		return fmt.Errorf("mount image: %w", err)
-	}
+		// Set CDROM flag
+		cdromValue := "0"
+		if lun.CDROM {
+			cdromValue = "1"
+		}
+		logger.Info("Setting CDROM flag", "lun", i, "value", cdromValue)
+		if err := writeFile(filepath.Join(lunRoot, "cdrom"), cdromValue); err != nil {
+			return fmt.Errorf("set cdrom flag: %w", err)
+		}
+
+		// Set read-only flag
+		roValue := "1"
+		if lun.ReadWrite {
+			roValue = "0"
+		}
+		logger.Info("Setting read-only flag", "lun", i, "value", roValue)
+		if err := writeFile(filepath.Join(lunRoot, "ro"), roValue); err != nil {
+			return fmt.Errorf("set ro flag: %w", err)
+		}
+
+		if err := setLUNAttributes(lunRoot, lun.LUNAttributes); err != nil {
+			return fmt.Errorf("lun.%d: %w", i, err)
+		}
+
+		// Mount the image
+		logger.Info("Writing image path to LUN", "lun", i)
+		if err := writeFile(lunFile, lun.File); err != nil {
+			return fmt.Errorf("mount image: %w", err)
+		}
 
-	// Verify mount succeeded
-	logger.Info("Verifying mount")
-	if err := verifyMount(lunFile, imagePath); err != nil {
-		return fmt.Errorf("verify mount: %w", err)
+		// Verify mount succeeded
+		logger.Info("Verifying mount", "lun", i)
+		if err := verifyMount(lunFile, lun.File); err != nil {
+			return fmt.Errorf("verify mount: %w", err)
+		}
 	}
 
 	logger.Info("Mount verified successfully")
 	return nil
 }
 
+// removeExtraLUNs clears and removes the LUNs from lun.<keep> on. lun.0
+// belongs to the function and cannot be removed.
+func (c *ConfigFSBackend) removeExtraLUNs(massStorageRoot string, keep int) error {
+	for i := 1; ; i++ {
+		lunRoot := filepath.Join(massStorageRoot, fmt.Sprintf("lun.%d", i))
+		if !dirExists(lunRoot) {
+			return nil
+		}
+		if i < keep {
+			continue
+		}
+		logger.Info("Removing LUN", "lun", i)
+		if err := writeFile(filepath.Join(lunRoot, "file"), ""); err != nil {
+			return fmt.Errorf("clear lun.%d file: %w", i, err)
+		}
+		if err := os.Remove(lunRoot); err != nil {
+			return fmt.Errorf("remove lun.%d: %w", i, err)
+		}
+	}
+}
+
 func (c *ConfigFSBackend) Unmount() error {
 	gadgetRoot, err := c.findGadgetRoot()
 	if err != nil {
@@ -141,9 +201,18 @@ func (c *ConfigFSBackend) Unmount() error {
 		}
 	}()
 
+	if err := applyDescriptors(gadgetRoot, nil); err != nil {
+		return fmt.Errorf("gadget descriptors: %w", err)
+	}
+
 	massStorageRoot := filepath.Join(gadgetRoot, "functions", "mass_storage.0")
 	lunFile := filepath.Join(massStorageRoot, "lun.0", "file")
 
+	// Remove the extra LUNs of a multi-LUN mount
+	if err := c.removeExtraLUNs(massStorageRoot, 1); err != nil {
+		return err
+	}
+
 	// Clear the file
 	logger.Info("Clearing LUN file")
 	if err := writeFile(lunFile, ""); err != nil {
@@ -182,12 +251,30 @@ func (c *ConfigFSBackend) Status() (*MountStatus, error) {
 	cdrom, _ := readFile(filepath.Join(lunRoot, "cdrom"))
 	ro, _ := readFile(filepath.Join(lunRoot, "ro"))
 
-	return &MountStatus{
-		Mounted:  true,
-		File:     file,
-		ReadOnly: ro == "1",
-		CDROM:    cdrom == "1",
-	}, nil
+	status := &MountStatus{
+		Mounted:    true,
+		File:       file,
+		ReadOnly:   ro == "1",
+		CDROM:      cdrom == "1",
+		Attributes: readLUNAttributes(lunRoot),
+	}
+	for i := 1; ; i++ {
+		lunRoot := filepath.Join(massStorageRoot, fmt.Sprintf("lun.%d", i))
+		file, err := readFile(filepath.Join(lunRoot, "file"))
+		if err != nil {
+			break
+		}
+		cdrom, _ := readFile(filepath.Join(lunRoot, "cdrom"))
+		ro, _ := readFile(filepath.Join(lunRoot, "ro"))
+		status.LUNs = append(status.LUNs, MountStatus{
+			Mounted:    file != "",
+			File:       file,
+			ReadOnly:   ro == "1",
+			CDROM:      cdrom == "1",
+			Attributes: readLUNAttributes(lunRoot),
+		})
+	}
+	return status, nil
 }
 
 func (c *ConfigFSBackend) findGadgetRoot() (string, error) {
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// diskImage is a virtual disk decoded to its raw contents. Unallocated
+// regions read as zeros.
+type diskImage interface {
+	io.ReaderAt
+	Size() int64
+	Close() error
+}
+
+// diskFormat describes a virtual disk container format that can be
+// converted to a raw image
+type diskFormat struct {
+	name  string
+	exts  []string
+	probe func(header, trailer []byte) bool
+	open  func(path string) (diskImage, error)
+}
+
+var diskFormats = []diskFormat{
+	{
+		name: "qcow2",
+		exts: []string{".qcow2", ".qcow"},
+		probe: func(header, trailer []byte) bool {
+			return bytes.HasPrefix(header, qcow2Magic)
+		},
+		open: openQcow2,
+	},
+	{
+		name: "vhdx",
+		exts: []string{".vhdx"},
+		probe: func(header, trailer []byte) bool {
+			return bytes.HasPrefix(header, vhdxMagic)
+		},
+		open: openVHDX,
+	},
+	{
+		name: "vhd",
+		exts: []string{".vhd"},
+		probe: func(header, trailer []byte) bool {
+			return bytes.HasPrefix(trailer, vhdMagic)
+		},
+		open: openVHD,
+	},
+	{
+		name: "vmdk",
+		exts: []string{".vmdk"},
+		probe: func(header, trailer []byte) bool {
+			return bytes.HasPrefix(header, vmdkMagic) || bytes.HasPrefix(header, vmdkDescriptorMagic)
+		},
+		open: openVMDK,
+	},
+	{
+		name: "dmg",
+		exts: []string{".dmg"},
+		probe: func(header, trailer []byte) bool {
+			return bytes.HasPrefix(trailer, dmgMagic)
+		},
+		open: openDMG,
+	},
+}
+
+// detectDiskFormat returns the virtual disk format of path, or nil if the
+// file is not a supported virtual disk container.
+func detectDiskFormat(path string) (*diskFormat, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 512)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	header = header[:n]
+
+	var trailer []byte
+	if info.Size() >= 1024 {
+		trailer = make([]byte, 512)
+		if _, err := file.ReadAt(trailer, info.Size()-512); err != nil {
+			return nil, fmt.Errorf("read trailer: %w", err)
+		}
+	}
+
+	for i := range diskFormats {
+		if diskFormats[i].probe(header, trailer) {
+			return &diskFormats[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// convertImage writes the raw contents of img to out as a sparse file
+func convertImage(img diskImage, out *os.File, label string) error {
+	progress := newProgress(label, img.Size())
+	src := io.TeeReader(io.NewSectionReader(img, 0, img.Size()), progress)
+	_, err := copySparse(out, src)
+	progress.Done()
+	return err
+}
+
+// convertFile converts the virtual disk at src into a raw image at dst
+func convertFile(src, dst string, format *diskFormat) error {
+	img, err := format.open(src)
+	if err != nil {
+		return fmt.Errorf("open %s image: %w", format.name, err)
+	}
+	defer img.Close()
+
+	logger.Info("Converting image", "format", format.name, "size", img.Size(), "source", src, "target", dst)
+
+	tmp := dst + ".part"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	if err := convertImage(img, out, "Converting "+format.name); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("convert %s: %w", format.name, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// convertToCache converts a virtual disk into the image cache and returns
+// the path of the raw copy. An existing cached copy is reused.
+func convertToCache(path string, format *diskFormat, cacheLimit int64) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	target := cachePath(path, info, rawImageName(path, format))
+	if cacheLookup(target) {
+		logger.Info("Using cached converted image", "path", target)
+		return target, nil
+	}
+
+	img, err := format.open(path)
+	if err != nil {
+		return "", fmt.Errorf("open %s image: %w", format.name, err)
+	}
+	defer img.Close()
+
+	logger.Info("Converting image", "format", format.name, "size", img.Size(), "source", path, "target", target)
+	err = cacheCreate(target, func(out *os.File) error {
+		if err := convertImage(img, out, "Converting "+format.name); err != nil {
+			return fmt.Errorf("convert %s: %w", format.name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := evictCache(cacheLimit, target); err != nil {
+		logger.Warn("Failed to evict cached images", "error", err)
+	}
+
+	return target, nil
+}
+
+// rawImageName replaces the virtual disk extension of path with ".img"
+func rawImageName(path string, format *diskFormat) string {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	for _, e := range format.exts {
+		if strings.EqualFold(ext, e) {
+			return name[:len(name)-len(ext)] + ".img"
+		}
+	}
+	return name + ".img"
+}
+
+// readZeros fills p with zeros and returns its length
+func readZeros(p []byte) int {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p)
+}
+
+// checkTable makes sure a table named in an image header lies within the
+// file before it is allocated, so a corrupt header can't ask for gigabytes
+func checkTable(file *os.File, name string, offset, length int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if offset < 0 || length < 0 || length > info.Size() || offset > info.Size()-length {
+		return fmt.Errorf("invalid %s: %d bytes at %d in a %d byte file", name, length, offset, info.Size())
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	isoSectorSize    = 2048
+	isoDescriptorOff = 16 * isoSectorSize
+	mbrSignatureOff  = 510
+	mbrPartTableOff  = 446
+	mbrPartEntrySize = 16
+)
+
+var (
+	isoMagic = []byte("CD001")
+	gptMagic = []byte("EFI PART")
+)
+
+// ImageInfo describes what was found when probing an image's content.
+type ImageInfo struct {
+	ISO9660 bool // ISO9660 primary volume descriptor present
+	MBR     bool // MBR with at least one non-empty partition entry
+	GPT     bool // GPT header present (512 or 4096 byte sectors)
+}
+
+// Partitioned reports whether the image carries a partition table.
+func (i *ImageInfo) Partitioned() bool {
+	return i.MBR || i.GPT
+}
+
+// probeImage inspects the first sectors of an image, starting at offset,
+// for ISO9660 and partition table signatures.
+func probeImage(path string, offset int64) (*ImageInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Enough to cover the ISO volume descriptor and a 4K-sector GPT header
+	buf := make([]byte, isoDescriptorOff+isoSectorSize)
+	n, err := file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read image header: %w", err)
+	}
+	buf = buf[:n]
+
+	info := &ImageInfo{}
+
+	if len(buf) >= isoDescriptorOff+6 {
+		info.ISO9660 = bytes.Equal(buf[isoDescriptorOff+1:isoDescriptorOff+6], isoMagic)
+	}
+
+	for _, off := range []int{512, 4096} {
+		if len(buf) >= off+len(gptMagic) && bytes.Equal(buf[off:off+len(gptMagic)], gptMagic) {
+			info.GPT = true
+		}
+	}
+
+	if len(buf) >= 512 && binary.LittleEndian.Uint16(buf[mbrSignatureOff:]) == 0xAA55 {
+		for i := 0; i < 4; i++ {
+			entry := buf[mbrPartTableOff+i*mbrPartEntrySize : mbrPartTableOff+(i+1)*mbrPartEntrySize]
+			partType := entry[4]
+			sectors := binary.LittleEndian.Uint32(entry[12:])
+			// A boot flag of anything other than 0x00/0x80 means this is a
+			// filesystem boot sector (e.g. FAT), not a partition table
+			if partType != 0 && sectors != 0 && (entry[0] == 0x00 || entry[0] == 0x80) {
+				info.MBR = true
+				break
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// detectMode picks a mount mode ("cdrom", "ro" or "rw") from the image
+// content at offset and returns a human-readable reason for the choice.
+func detectMode(path string, offset int64) (string, string, error) {
+	info, err := probeImage(path, offset)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case info.ISO9660 && !info.Partitioned():
+		return "cdrom", "ISO9660 image without partition table", nil
+	case info.ISO9660:
+		return "ro", "hybrid ISO9660 image with partition table", nil
+	case info.Partitioned():
+		return "rw", "partitioned disk image", nil
+	default:
+		return "rw", "raw filesystem or unrecognized image", nil
+	}
+}
+
+// isoVolumeSize returns the size the ISO9660 primary volume descriptor of
+// an image declares, or 0 if it has none
+func isoVolumeSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	pvd := make([]byte, isoSectorSize)
+	if _, err := file.ReadAt(pvd, isoDescriptorOff); err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("read volume descriptor: %w", err)
+	}
+	if pvd[0] != 1 || !bytes.Equal(pvd[1:6], isoMagic) {
+		return 0, nil
+	}
+	blocks := int64(binary.LittleEndian.Uint32(pvd[80:]))
+	blockSize := int64(binary.LittleEndian.Uint16(pvd[128:]))
+	return blocks * blockSize, nil
+}
+
+// Partition is an entry of an MBR or GPT partition table
+type Partition struct {
+	Number int
+	Offset int64
+	Size   int64
+}
+
+// readPartitions lists the partitions of a disk image. GPT partitions are
+// numbered by table slot, MBR logical partitions start at 5.
+func readPartitions(path string) ([]Partition, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	for _, sectorSize := range []int64{512, 4096} {
+		header := make([]byte, 92)
+		if _, err := file.ReadAt(header, sectorSize); err != nil {
+			continue
+		}
+		if bytes.HasPrefix(header, gptMagic) {
+			return readGPT(file, header, sectorSize)
+		}
+	}
+
+	mbr := make([]byte, 512)
+	if _, err := file.ReadAt(mbr, 0); err != nil {
+		return nil, fmt.Errorf("read MBR: %w", err)
+	}
+	if binary.LittleEndian.Uint16(mbr[mbrSignatureOff:]) != 0xAA55 {
+		return nil, fmt.Errorf("no partition table found")
+	}
+	return readMBR(file, mbr)
+}
+
+func readGPT(file *os.File, header []byte, sectorSize int64) ([]Partition, error) {
+	le := binary.LittleEndian
+	entriesLBA := int64(le.Uint64(header[72:]))
+	count := le.Uint32(header[80:])
+	entrySize := le.Uint32(header[84:])
+	// Entries are 128 bytes in practice; the bound keeps a corrupt header
+	// from asking for gigabytes of entries
+	if entrySize < 128 || entrySize > 4096 || entrySize%128 != 0 || count > 1024 {
+		return nil, fmt.Errorf("invalid GPT header")
+	}
+
+	raw := make([]byte, int64(count)*int64(entrySize))
+	if _, err := file.ReadAt(raw, entriesLBA*sectorSize); err != nil {
+		return nil, fmt.Errorf("read GPT entries: %w", err)
+	}
+
+	var parts []Partition
+	for i := uint32(0); i < count; i++ {
+		entry := raw[i*entrySize : (i+1)*entrySize]
+		if isZero(entry[:16]) {
+			continue
+		}
+		first := int64(le.Uint64(entry[32:]))
+		last := int64(le.Uint64(entry[40:]))
+		parts = append(parts, Partition{
+			Number: int(i) + 1,
+			Offset: first * sectorSize,
+			Size:   (last - first + 1) * sectorSize,
+		})
+	}
+	return parts, nil
+}
+
+func readMBR(file *os.File, mbr []byte) ([]Partition, error) {
+	le := binary.LittleEndian
+	var parts []Partition
+	for i := 0; i < 4; i++ {
+		entry := mbr[mbrPartTableOff+i*mbrPartEntrySize:]
+		partType := entry[4]
+		start := int64(le.Uint32(entry[8:]))
+		sectors := int64(le.Uint32(entry[12:]))
+		if partType == 0 || sectors == 0 {
+			continue
+		}
+
+		if partType == 0x05 || partType == 0x0f || partType == 0x85 {
+			logical, err := readEBRChain(file, start)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, logical...)
+			continue
+		}
+
+		parts = append(parts, Partition{Number: i + 1, Offset: start * 512, Size: sectors * 512})
+	}
+	return parts, nil
+}
+
+// readEBRChain follows the linked list of extended boot records
+func readEBRChain(file *os.File, extStart int64) ([]Partition, error) {
+	le := binary.LittleEndian
+	var parts []Partition
+	ebr := make([]byte, 512)
+	current := extStart
+	for number := 5; number < 64; number++ {
+		if _, err := file.ReadAt(ebr, current*512); err != nil {
+			return nil, fmt.Errorf("read EBR: %w", err)
+		}
+		if le.Uint16(ebr[mbrSignatureOff:]) != 0xAA55 {
+			break
+		}
+
+		entry := ebr[mbrPartTableOff:]
+		if sectors := int64(le.Uint32(entry[12:])); entry[4] != 0 && sectors != 0 {
+			start := current + int64(le.Uint32(entry[8:]))
+			parts = append(parts, Partition{Number: number, Offset: start * 512, Size: sectors * 512})
+		}
+
+		next := ebr[mbrPartTableOff+mbrPartEntrySize:]
+		if next[4] == 0 {
+			break
+		}
+		current = extStart + int64(le.Uint32(next[8:]))
+	}
+	return parts, nil
+}
+
+// findPartition returns the partition with the given number
+func findPartition(path string, number int) (*Partition, error) {
+	parts, err := readPartitions(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range parts {
+		if parts[i].Number == number {
+			return &parts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("partition %d not found (image has %d partitions)", number, len(parts))
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDirFree is the free space of a writable directory drive
+const defaultDirFree = 1 << 30
+
+// DirDrive is a writable directory drive whose changes are copied back to
+// the directory when it is unmounted
+type DirDrive struct {
+	Dir   string             `json:"dir"`
+	Image string             `json:"image"`
+	Files map[string]DirFile `json:"files"`
+}
+
+// DirFile records a file as it was when the drive was built: size and
+// mtime in the directory, first cluster and write stamp in the image
+type DirFile struct {
+	Dir     bool   `json:"dir,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Cluster uint32 `json:"cluster"`
+	Stamp   uint32 `json:"stamp"`
+}
+
+// dirSync counts the changes copied back from a directory drive
+type dirSync struct {
+	added, modified, deleted int
+	conflicts                []string
+}
+
+// planDirImage scans dir and lays out a FAT32 volume for it
+func planDirImage(dir string, extra int64) (string, *fatVolume, string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("resolve path: %w", err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", nil, "", fmt.Errorf("resolve symlinks: %w", err)
+	}
+	if err := validateSafePath(dir); err != nil {
+		return "", nil, "", err
+	}
+
+	root, fingerprint, err := scanFATTree(dir)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("scan directory: %w", err)
+	}
+
+	sum, _ := hex.DecodeString(fingerprint[:8])
+	vol, err := planFAT(root, fatLabel(filepath.Base(dir)), extra, binary.LittleEndian.Uint32(sum), 0)
+	if err != nil {
+		return "", nil, "", err
+	}
+	return dir, vol, fingerprint, nil
+}
+
+// buildDirImage returns a cached FAT32 image holding the contents of dir.
+// The image is regenerated only when a name, size or mtime in the tree
+// changes. In a dry run the image path is returned without building it.
+func buildDirImage(dir string, cacheLimit int64, dryRun bool) (string, error) {
+	dir, vol, fingerprint, err := planDirImage(dir, 0)
+	if err != nil {
+		return "", err
+	}
+
+	target := cacheKeyPath("dir|"+dir+"|"+fingerprint, filepath.Base(dir)+".fat.img")
+	if cacheLookup(target) {
+		logger.Info("Using cached directory image", "path", target)
+		return target, nil
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: Would build FAT32 image of %s (%d files, %d bytes) into %s\n", dir, vol.files, vol.bytes, cacheDir())
+		return target, nil
+	}
+
+	logger.Info("Building directory image", "dir", dir, "files", vol.files, "bytes", vol.bytes, "target", target)
+	err = cacheCreate(target, func(out *os.File) error {
+		if err := vol.write(out); err != nil {
+			return fmt.Errorf("build FAT image: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := evictCache(cacheLimit, target); err != nil {
+		logger.Warn("Failed to evict cached images", "error", err)
+	}
+
+	return target, nil
+}
+
+// buildDirDrive builds a writable FAT32 image of dir with extra bytes of
+// free space and records the initial state of every file for syncing
+func buildDirDrive(dir string, extra int64, dryRun bool) (*DirDrive, error) {
+	dir, vol, _, err := planDirImage(dir, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256([]byte(dir))
+	drive := &DirDrive{
+		Dir:   dir,
+		Image: filepath.Join(stateDir, "dirs", hex.EncodeToString(sum[:8])+"-"+filepath.Base(dir)+".fat.img"),
+		Files: map[string]DirFile{},
+	}
+
+	state, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range state.Dirs {
+		if d.Dir == dir {
+			return nil, fmt.Errorf("%s is already mounted or has unsynced changes in %s\nHint: Run 'usbdrive umount' to sync it back first", dir, d.Image)
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: Would build writable FAT32 image of %s (%d files, %d bytes, %d bytes free) at %s\n", dir, vol.files, vol.bytes, extra, drive.Image)
+		return drive, nil
+	}
+
+	var record func(node *fatNode, rel string)
+	record = func(node *fatNode, rel string) {
+		for _, child := range node.children {
+			childRel := path.Join(rel, child.name)
+			date, clock, _ := fatTimestamp(child.modTime)
+			drive.Files[childRel] = DirFile{
+				Dir:     child.dir,
+				Size:    child.size,
+				ModTime: child.modTime.UnixNano(),
+				Cluster: child.cluster,
+				Stamp:   uint32(date)<<16 | uint32(clock),
+			}
+			if child.dir {
+				record(child, childRel)
+			}
+		}
+	}
+	record(vol.root, "")
+
+	if err := os.MkdirAll(filepath.Dir(drive.Image), 0700); err != nil {
+		return nil, fmt.Errorf("create image dir: %w", err)
+	}
+	out, err := os.OpenFile(drive.Image, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+	logger.Info("Building writable directory image", "dir", dir, "files", vol.files, "bytes", vol.bytes, "target", drive.Image)
+	err = vol.write(out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(drive.Image)
+		return nil, fmt.Errorf("build FAT image: %w", err)
+	}
+
+	return drive, nil
+}
+
+// recordDirDrive adds a directory drive to the state so it is synced back
+// when it is no longer mounted
+func recordDirDrive(drive *DirDrive) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	state.Dirs = append(state.Dirs, *drive)
+	return state.save()
+}
+
+// releaseDirDrives syncs recorded directory drives that are no longer
+// attached to a LUN back into their directories and removes their images.
+// Drives that fail to sync are kept so the sync can be retried.
+func releaseDirDrives() error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if len(state.Dirs) == 0 {
+		return nil
+	}
+
+	mounted := map[string]bool{}
+	for _, file := range mountedFiles() {
+		mounted[file] = true
+	}
+
+	var kept []DirDrive
+	var errs []string
+	for _, drive := range state.Dirs {
+		if mounted[drive.Image] {
+			kept = append(kept, drive)
+			continue
+		}
+
+		logger.Info("Syncing directory drive", "dir", drive.Dir, "image", drive.Image)
+		result, err := syncDirDrive(&drive)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v (image kept at %s)", drive.Dir, err, drive.Image))
+			kept = append(kept, drive)
+			continue
+		}
+
+		fmt.Printf("Synced %s: %d added, %d modified, %d deleted\n", drive.Dir, result.added, result.modified, result.deleted)
+		for _, conflict := range result.conflicts {
+			fmt.Printf("Conflict: %s\n", conflict)
+		}
+		if err := os.Remove(drive.Image); err != nil {
+			logger.Warn("Failed to remove directory image", "path", drive.Image, "error", err)
+		}
+	}
+
+	state.Dirs = kept
+	if err := state.save(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("sync directory drives: %s\nHint: Run 'usbdrive umount' again to retry", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// syncDirDrive applies the additions, modifications and deletions made on
+// the host to the directory. Files changed on both sides are conflicts: the
+// phone's version is kept and the host's version is saved next to it.
+func syncDirDrive(drive *DirDrive) (*dirSync, error) {
+	reader, err := openFAT(drive.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	entries, err := reader.walk()
+	if err != nil {
+		return nil, fmt.Errorf("read image: %w", err)
+	}
+
+	host := map[string]*fatEntry{}
+	for i := range entries {
+		host[entries[i].path] = &entries[i]
+	}
+
+	result := &dirSync{}
+
+	// Deletions first, so a case-only rename does not remove the new name
+	var removed []string
+	for rel := range drive.Files {
+		if host[rel] == nil {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(removed)))
+	for _, rel := range removed {
+		base := drive.Files[rel]
+		if link := linkedParent(drive.Dir, rel); link != "" {
+			result.conflicts = append(result.conflicts, fmt.Sprintf("%s: deleted on host, %s is a link on phone (kept)", rel, link))
+			continue
+		}
+		target := filepath.Join(drive.Dir, filepath.FromSlash(rel))
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if base.Dir {
+			// Directories the phone added files to are left in place
+			if err := os.Remove(target); err == nil {
+				result.deleted++
+			} else {
+				logger.Info("Keeping non-empty directory", "path", target)
+			}
+			continue
+		}
+		if phoneChanged(info, base) {
+			result.conflicts = append(result.conflicts, rel+": deleted on host, changed on phone (kept)")
+			continue
+		}
+		if err := os.Remove(target); err != nil {
+			return result, err
+		}
+		result.deleted++
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if !validSyncPath(entry.path) {
+			logger.Warn("Skipping invalid name from host", "path", entry.path)
+			continue
+		}
+		// Writing through a link would change files outside the directory
+		if link := linkedParent(drive.Dir, entry.path); link != "" {
+			result.conflicts = append(result.conflicts, fmt.Sprintf("%s: changed on host, %s is a link on phone (skipped)", entry.path, link))
+			continue
+		}
+		target := filepath.Join(drive.Dir, filepath.FromSlash(entry.path))
+		base, known := drive.Files[entry.path]
+		info, statErr := os.Lstat(target)
+		exists := statErr == nil
+
+		if entry.dir {
+			if !exists {
+				if err := os.MkdirAll(target, 0775); err != nil {
+					return result, err
+				}
+				result.added++
+			} else if !info.IsDir() {
+				result.conflicts = append(result.conflicts, entry.path+": directory on host, file on phone (kept)")
+			}
+			continue
+		}
+
+		if known && !hostChanged(entry, base) {
+			continue
+		}
+
+		switch {
+		case exists && info.IsDir():
+			result.conflicts = append(result.conflicts, entry.path+": file on host, directory on phone (kept)")
+		case known && !exists:
+			if err := copyOut(reader, entry, target); err != nil {
+				return result, err
+			}
+			result.conflicts = append(result.conflicts, entry.path+": changed on host, deleted on phone (restored)")
+		case (known && phoneChanged(info, base)) || (!known && exists):
+			saved := conflictPath(target)
+			if err := copyOut(reader, entry, saved); err != nil {
+				return result, err
+			}
+			result.conflicts = append(result.conflicts, fmt.Sprintf("%s: changed on both sides (host version saved as %s)", entry.path, filepath.Base(saved)))
+		default:
+			if err := copyOut(reader, entry, target); err != nil {
+				return result, err
+			}
+			if known {
+				result.modified++
+			} else {
+				result.added++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// phoneChanged reports whether a file in the directory differs from the
+// state recorded when the drive was built
+func phoneChanged(info os.FileInfo, base DirFile) bool {
+	return info.IsDir() != base.Dir || (!base.Dir && (info.Size() != base.Size || info.ModTime().UnixNano() != base.ModTime))
+}
+
+// hostChanged reports whether a file in the image differs from the state
+// it was written with. Hosts update the write time on every change, and
+// usually allocate new clusters when a file is replaced.
+func hostChanged(entry *fatEntry, base DirFile) bool {
+	stamp := uint32(entry.date)<<16 | uint32(entry.time)
+	return entry.dir != base.Dir || entry.size != base.Size || entry.cluster != base.Cluster || stamp != base.Stamp
+}
+
+// validSyncPath rejects names that would escape the directory
+func validSyncPath(rel string) bool {
+	for _, part := range strings.Split(rel, "/") {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "\\\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// linkedParent returns the first parent directory of rel that is a link or
+// not a directory on the phone, or "" if writing below dir stays inside it
+func linkedParent(dir, rel string) string {
+	parts := strings.Split(rel, "/")
+	path := dir
+	for i, part := range parts[:len(parts)-1] {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			return ""
+		}
+		if err != nil || !info.IsDir() {
+			return strings.Join(parts[:i+1], "/")
+		}
+	}
+	return ""
+}
+
+// conflictPath returns an unused name for the host's copy of a conflicting
+// file, e.g. "notes (host copy).txt"
+func conflictPath(target string) string {
+	ext := filepath.Ext(target)
+	stem := strings.TrimSuffix(target, ext)
+	candidate := stem + " (host copy)" + ext
+	for n := 2; pathExists(candidate); n++ {
+		candidate = fmt.Sprintf("%s (host copy %d)%s", stem, n, ext)
+	}
+	return candidate
+}
+
+// copyOut writes a file from the image to target through a temporary file
+// and sets its mtime to the host's write time
+func copyOut(reader *fatReader, entry *fatEntry, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0775); err != nil {
+		return err
+	}
+	tmp := target + ".usbdrive-sync"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+
+	err = reader.copyFile(entry, out)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, target)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("copy %s: %w", entry.path, err)
+	}
+
+	modTime := entry.modTime()
+	if err := os.Chtimes(target, time.Now(), modTime); err != nil {
+		logger.Warn("Failed to set modification time", "path", target, "error", err)
+	}
+	logger.Info("Synced file from host", "path", target, "size", entry.size)
+	return nil
+}
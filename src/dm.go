@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	dmIoctlSize = 312 // sizeof(struct dm_ioctl)
+	dmSpecSize  = 40  // sizeof(struct dm_target_spec)
+
+	dmDevCreate   = 3
+	dmDevRemove   = 4
+	dmDevSuspend  = 6
+	dmTableLoad   = 9
+	dmTableStatus = 12
+
+	dmReadOnlyFlag   = 1 << 0
+	dmBufferFullFlag = 1 << 8
+)
+
+// dmControlPaths are where the device-mapper control node lives on Linux
+// and Android
+var dmControlPaths = []string{"/dev/mapper/control", "/dev/device-mapper"}
+
+// dmIoctl mirrors struct dm_ioctl from <linux/dm-ioctl.h>
+type dmIoctl struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	Padding     uint32
+	Dev         uint64
+	Name        [128]byte
+	UUID        [129]byte
+	Data        [7]byte
+}
+
+// dmTarget is one line of a device-mapper table, in 512-byte sectors
+type dmTarget struct {
+	Start  int64
+	Length int64
+	Type   string
+	Params string
+}
+
+// dmSupported reports whether the kernel exposes device-mapper
+func dmSupported() bool {
+	_, err := dmControl()
+	return err == nil
+}
+
+func dmControl() (string, error) {
+	for _, path := range dmControlPaths {
+		if pathExists(path) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("device-mapper not available (no %s)", strings.Join(dmControlPaths, " or "))
+}
+
+// dmCall issues a device-mapper ioctl for the named device with data after
+// the header, and returns the header and data the kernel wrote back
+func dmCall(cmd uintptr, name string, flags uint32, targets uint32, data []byte) (*dmIoctl, []byte, error) {
+	control, err := dmControl()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctl, err := os.OpenFile(control, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open device-mapper control: %w", err)
+	}
+	defer ctl.Close()
+
+	size := dmIoctlSize + len(data) + 16<<10
+	for {
+		buf := make([]byte, size)
+		header := (*dmIoctl)(unsafe.Pointer(&buf[0]))
+		header.Version = [3]uint32{4, 0, 0}
+		header.DataSize = uint32(size)
+		header.DataStart = dmIoctlSize
+		header.TargetCount = targets
+		header.Flags = flags
+		copy(header.Name[:len(header.Name)-1], name)
+		copy(buf[dmIoctlSize:], data)
+
+		request := uintptr(3<<30|dmIoctlSize<<16|0xfd<<8) | cmd
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ctl.Fd(), request, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return nil, nil, errno
+		}
+		if header.Flags&dmBufferFullFlag != 0 {
+			size *= 2
+			continue
+		}
+		result := *header
+		return &result, buf[header.DataStart:header.DataSize], nil
+	}
+}
+
+// dmCreate creates and activates a device-mapper device and returns its
+// device node
+func dmCreate(name string, targets []dmTarget, readOnly bool) (string, error) {
+	header, _, err := dmCall(dmDevCreate, name, 0, 0, nil)
+	if err != nil {
+		return "", fmt.Errorf("create %s: %w", name, err)
+	}
+
+	var table []byte
+	for _, t := range targets {
+		params := append([]byte(t.Params), 0)
+		for (dmSpecSize+len(params))%8 != 0 {
+			params = append(params, 0)
+		}
+		spec := make([]byte, dmSpecSize)
+		binary.LittleEndian.PutUint64(spec[0:], uint64(t.Start))
+		binary.LittleEndian.PutUint64(spec[8:], uint64(t.Length))
+		binary.LittleEndian.PutUint32(spec[20:], uint32(dmSpecSize+len(params)))
+		copy(spec[24:39], t.Type)
+		table = append(table, spec...)
+		table = append(table, params...)
+	}
+
+	var flags uint32
+	if readOnly {
+		flags = dmReadOnlyFlag
+	}
+	if _, _, err := dmCall(dmTableLoad, name, flags, uint32(len(targets)), table); err != nil {
+		dmRemove(name)
+		return "", fmt.Errorf("load table for %s: %w", name, err)
+	}
+	// Resuming a device with a loaded table activates it
+	if _, _, err := dmCall(dmDevSuspend, name, 0, 0, nil); err != nil {
+		dmRemove(name)
+		return "", fmt.Errorf("activate %s: %w", name, err)
+	}
+
+	device, err := dmDevicePath(header.Dev)
+	if err != nil {
+		dmRemove(name)
+		return "", err
+	}
+	logger.Info("Created device-mapper device", "name", name, "device", device, "targets", len(targets))
+	return device, nil
+}
+
+// dmRemove removes a device-mapper device, retrying while udev or the
+// gadget driver still holds it open
+func dmRemove(name string) error {
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		_, _, err = dmCall(dmDevRemove, name, 0, 0, nil)
+		if err == nil {
+			logger.Info("Removed device-mapper device", "name", name)
+			return nil
+		}
+		if err == syscall.ENXIO {
+			return nil
+		}
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("remove %s: %w", name, err)
+}
+
+// dmStatus returns the status line of each target of a device
+func dmStatus(name string) ([]string, error) {
+	header, data, err := dmCall(dmTableStatus, name, 0, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	offset := uint32(0)
+	for i := uint32(0); i < header.TargetCount; i++ {
+		if int(offset)+dmSpecSize > len(data) {
+			break
+		}
+		spec := data[offset:]
+		params := spec[dmSpecSize:]
+		if end := bytes.IndexByte(params, 0); end >= 0 {
+			params = params[:end]
+		}
+		lines = append(lines, string(params))
+		// Status results chain specs relative to the start of the data
+		offset = binary.LittleEndian.Uint32(spec[20:])
+	}
+	return lines, nil
+}
+
+// dmDevicePath returns the node of a device-mapper device, creating it if
+// ueventd has not done so yet
+func dmDevicePath(dev uint64) (string, error) {
+	major := uint32((dev & 0xfff00) >> 8)
+	minor := uint32(dev&0xff | (dev>>12)&0xfff00)
+	candidates := []string{
+		fmt.Sprintf("/dev/block/dm-%d", minor),
+		fmt.Sprintf("/dev/dm-%d", minor),
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, path := range candidates {
+			if pathExists(path) {
+				return path, nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	path := candidates[0]
+	if !dirExists(filepath.Dir(path)) {
+		path = candidates[1]
+	}
+	logger.Info("Creating device-mapper device node", "path", path)
+	node := int(minor&0xff | major<<8 | (minor&^0xff)<<12)
+	if err := syscall.Mknod(path, syscall.S_IFBLK|0600, node); err != nil {
+		return "", fmt.Errorf("create %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// dmSlaves returns the device nodes a device-mapper device is built on,
+// including those beneath stacked device-mapper devices
+func dmSlaves(path string) []string {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "dm-") {
+		return nil
+	}
+	if _, err := strconv.Atoi(strings.TrimPrefix(name, "dm-")); err != nil {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join("/sys/block", name, "slaves"))
+	if err != nil {
+		return nil
+	}
+	var slaves []string
+	for _, entry := range entries {
+		for _, dir := range []string{"/dev/block", "/dev"} {
+			slaves = append(slaves, filepath.Join(dir, entry.Name()))
+		}
+		slaves = append(slaves, dmSlaves(entry.Name())...)
+	}
+	return slaves
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+var (
+	dmgMagic = []byte("koly")
+	dmgMish  = []byte("mish")
+)
+
+const (
+	dmgChunkZero    = 0x00000000
+	dmgChunkRaw     = 0x00000001
+	dmgChunkIgnore  = 0x00000002
+	dmgChunkADC     = 0x80000004
+	dmgChunkZlib    = 0x80000005
+	dmgChunkBzip2   = 0x80000006
+	dmgChunkLZFSE   = 0x80000007
+	dmgChunkComment = 0x7ffffffe
+	dmgChunkEnd     = 0xffffffff
+
+	// dmgMaxChunk bounds the sectors one data chunk decodes to. hdiutil
+	// writes 1 MiB chunks; the bound keeps a corrupt table from asking for
+	// gigabytes per chunk.
+	dmgMaxChunk = 64 << 20
+)
+
+// dmgChunk is a run of sectors stored with one encoding
+type dmgChunk struct {
+	kind   uint32
+	start  int64 // byte offset in the disk
+	length int64
+	offset int64 // byte offset of the stored data in the file
+	stored int64
+}
+
+// dmgImage reads Apple UDIF disk images (.dmg)
+type dmgImage struct {
+	file   *os.File
+	size   int64
+	chunks []dmgChunk
+
+	// Decompressed data of the most recently used chunk
+	cached int
+	data   []byte
+}
+
+func openDMG(path string) (diskImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := parseDMG(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func parseDMG(file *os.File) (*dmgImage, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, 512)
+	if _, err := file.ReadAt(trailer, info.Size()-512); err != nil {
+		return nil, fmt.Errorf("read trailer: %w", err)
+	}
+	if !bytes.HasPrefix(trailer, dmgMagic) {
+		return nil, fmt.Errorf("not a DMG image")
+	}
+
+	be := binary.BigEndian
+	dataForkOffset := int64(be.Uint64(trailer[24:]))
+	xmlOffset := int64(be.Uint64(trailer[216:]))
+	xmlLength := int64(be.Uint64(trailer[224:]))
+	if xmlLength == 0 {
+		return nil, fmt.Errorf("DMG image has no property list")
+	}
+
+	if err := checkTable(file, "DMG property list", xmlOffset, xmlLength); err != nil {
+		return nil, err
+	}
+	plist := make([]byte, xmlLength)
+	if _, err := file.ReadAt(plist, xmlOffset); err != nil {
+		return nil, fmt.Errorf("read property list: %w", err)
+	}
+	blocks, err := dmgBlockTables(plist)
+	if err != nil {
+		return nil, fmt.Errorf("parse property list: %w", err)
+	}
+
+	img := &dmgImage{file: file, cached: -1}
+	for _, table := range blocks {
+		if len(table) < 204 || !bytes.HasPrefix(table, dmgMish) {
+			return nil, fmt.Errorf("invalid block table")
+		}
+		firstSector := int64(be.Uint64(table[8:]))
+		dataOffset := int64(be.Uint64(table[24:]))
+		count := int(be.Uint32(table[200:]))
+		for i := 0; i < count && 204+(i+1)*40 <= len(table); i++ {
+			entry := table[204+i*40:]
+			chunk := dmgChunk{
+				kind:   be.Uint32(entry[0:]),
+				start:  (firstSector + int64(be.Uint64(entry[8:]))) * 512,
+				length: int64(be.Uint64(entry[16:])) * 512,
+				offset: dataForkOffset + dataOffset + int64(be.Uint64(entry[24:])),
+				stored: int64(be.Uint64(entry[32:])),
+			}
+			switch chunk.kind {
+			case dmgChunkComment, dmgChunkEnd:
+				continue
+			case dmgChunkADC, dmgChunkLZFSE:
+				return nil, fmt.Errorf("DMG compression type %#x is not supported\nHint: Convert it to a zlib or bzip2 compressed DMG first", chunk.kind)
+			}
+			if chunk.start < 0 || chunk.length < 0 || chunk.start > math.MaxInt64-chunk.length {
+				return nil, fmt.Errorf("invalid DMG chunk at sector %d", chunk.start/512)
+			}
+			if chunk.kind != dmgChunkZero && chunk.kind != dmgChunkIgnore &&
+				(chunk.length > dmgMaxChunk || chunk.stored < 0 || chunk.offset < 0 ||
+					chunk.stored > info.Size() || chunk.offset > info.Size()-chunk.stored) {
+				return nil, fmt.Errorf("invalid DMG chunk at sector %d: %d bytes stored at %d", chunk.start/512, chunk.stored, chunk.offset)
+			}
+			img.chunks = append(img.chunks, chunk)
+			if end := chunk.start + chunk.length; end > img.size {
+				img.size = end
+			}
+		}
+	}
+
+	if sectors := int64(be.Uint64(trailer[492:])); sectors*512 > img.size {
+		img.size = sectors * 512
+	}
+
+	sort.Slice(img.chunks, func(i, j int) bool {
+		return img.chunks[i].start < img.chunks[j].start
+	})
+
+	return img, nil
+}
+
+// dmgBlockTables extracts the base64 "mish" block tables from the blkx
+// array of the resource fork property list
+func dmgBlockTables(plist []byte) ([][]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(plist))
+	var tables [][]byte
+	var lastKey string
+	inBlkx := false
+	depth := 0
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch {
+			case t.Name.Local == "array" && lastKey == "blkx" && !inBlkx:
+				inBlkx = true
+				depth = 0
+			case inBlkx && t.Name.Local == "array":
+				depth++
+			case t.Name.Local == "key":
+				var key string
+				if err := decoder.DecodeElement(&key, &t); err != nil {
+					return nil, err
+				}
+				lastKey = key
+			case inBlkx && t.Name.Local == "data" && lastKey == "Data":
+				var text string
+				if err := decoder.DecodeElement(&text, &t); err != nil {
+					return nil, err
+				}
+				data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+				if err != nil {
+					return nil, err
+				}
+				tables = append(tables, data)
+			}
+		case xml.EndElement:
+			if inBlkx && t.Name.Local == "array" {
+				if depth == 0 {
+					inBlkx = false
+				} else {
+					depth--
+				}
+			}
+		}
+	}
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no blkx block tables found")
+	}
+	return tables, nil
+}
+
+func (d *dmgImage) Size() int64 {
+	return d.size
+}
+
+func (d *dmgImage) Close() error {
+	return d.file.Close()
+}
+
+func (d *dmgImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := d.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		i := sort.Search(len(d.chunks), func(i int) bool {
+			return d.chunks[i].start+d.chunks[i].length > pos
+		})
+
+		// Gap before the next chunk (or past the last one) reads as zeros
+		if i == len(d.chunks) || d.chunks[i].start > pos {
+			end := d.size
+			if i < len(d.chunks) {
+				end = d.chunks[i].start
+			}
+			n := int64(len(p) - read)
+			if n > end-pos {
+				n = end - pos
+			}
+			read += readZeros(p[read : read+int(n)])
+			continue
+		}
+
+		chunk := &d.chunks[i]
+		inChunk := pos - chunk.start
+		part := p[read:]
+		if int64(len(part)) > chunk.length-inChunk {
+			part = part[:chunk.length-inChunk]
+		}
+		if err := d.readChunk(i, part, inChunk); err != nil {
+			return read, err
+		}
+		read += len(part)
+	}
+	return read, eof
+}
+
+func (d *dmgImage) readChunk(i int, p []byte, inChunk int64) error {
+	chunk := &d.chunks[i]
+	switch chunk.kind {
+	case dmgChunkZero, dmgChunkIgnore:
+		readZeros(p)
+		return nil
+	case dmgChunkRaw:
+		if _, err := d.file.ReadAt(p, chunk.offset+inChunk); err != nil {
+			return fmt.Errorf("read raw chunk: %w", err)
+		}
+		return nil
+	}
+
+	if d.cached != i {
+		d.cached = -1
+		stored := io.NewSectionReader(d.file, chunk.offset, chunk.stored)
+		var r io.Reader
+		switch chunk.kind {
+		case dmgChunkZlib:
+			zr, err := zlib.NewReader(stored)
+			if err != nil {
+				return fmt.Errorf("open zlib chunk: %w", err)
+			}
+			defer zr.Close()
+			r = zr
+		case dmgChunkBzip2:
+			r = bzip2.NewReader(stored)
+		default:
+			return fmt.Errorf("unsupported DMG chunk type %#x", chunk.kind)
+		}
+
+		if int64(cap(d.data)) < chunk.length {
+			d.data = make([]byte, chunk.length)
+		}
+		d.data = d.data[:chunk.length]
+		n, err := io.ReadFull(r, d.data)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("decompress chunk: %w", err)
+		}
+		readZeros(d.data[n:])
+		d.cached = i
+	}
+
+	copy(p, d.data[inChunk:])
+	return nil
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatSectorSize      = 512
+	fatReservedSectors = 32
+	fatMinClusters     = 65536 // FAT32 needs more than 65524 clusters
+	fatMaxFileSize     = 1<<32 - 1
+	fatMaxNameLen      = 255
+	fatEntrySize       = 32
+	fatEOC             = 0x0fffffff
+
+	fatAttrReadOnly = 0x01
+	fatAttrVolumeID = 0x08
+	fatAttrDir      = 0x10
+	fatAttrArchive  = 0x20
+	fatAttrLFN      = 0x0f
+)
+
+// fatShortChars are the characters allowed in 8.3 names besides A-Z and 0-9
+const fatShortChars = "!#$%&'()-@^_`{}~"
+
+// fatNode is a file or directory placed in a generated FAT image
+type fatNode struct {
+	name     string
+	short    [11]byte
+	lfn      bool
+	source   string
+	dir      bool
+	size     int64
+	modTime  time.Time
+	accTime  time.Time
+	children []*fatNode
+	cluster  uint32
+	clusters uint32
+}
+
+// fatVolume is the planned layout of a FAT32 volume
+type fatVolume struct {
+	root          *fatNode
+	label         string
+	serial        uint32
+	clusterSize   int64
+	totalClusters uint32
+	fatSectors    uint32
+	reserved      uint32
+	totalSectors  uint32
+	usedClusters  uint32
+	files         int
+	bytes         int64
+	offset        int64 // byte offset of the volume in a partitioned image
+}
+
+// scanFATTree walks a directory and returns its tree along with a
+// fingerprint that changes whenever any name, size or mtime changes.
+// Symlinks and special files are skipped.
+func scanFATTree(root string) (*fatNode, string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, "", err
+	}
+	if !info.IsDir() {
+		return nil, "", fmt.Errorf("not a directory: %s", root)
+	}
+
+	hash := sha256.New()
+	node := &fatNode{source: root, dir: true, modTime: info.ModTime(), accTime: accessTime(info)}
+	if err := scanFATDir(node, "", hash); err != nil {
+		return nil, "", err
+	}
+	return node, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func scanFATDir(dir *fatNode, rel string, hash io.Writer) error {
+	entries, err := os.ReadDir(dir.source)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir.source, entry.Name())
+		relPath := filepath.Join(rel, entry.Name())
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			logger.Info("Skipping non-regular file", "path", path)
+			continue
+		}
+		if len(utf16.Encode([]rune(entry.Name()))) > fatMaxNameLen {
+			return fmt.Errorf("name too long for FAT: %s", path)
+		}
+
+		child := &fatNode{
+			name:    entry.Name(),
+			source:  path,
+			dir:     info.IsDir(),
+			modTime: info.ModTime(),
+			accTime: accessTime(info),
+		}
+		if !child.dir {
+			if info.Size() > fatMaxFileSize {
+				return fmt.Errorf("file larger than 4 GiB cannot be stored on FAT32: %s", path)
+			}
+			child.size = info.Size()
+		}
+		fmt.Fprintf(hash, "%s\x00%t\x00%d\x00%d\n", relPath, child.dir, child.size, child.modTime.UnixNano())
+
+		if child.dir {
+			if err := scanFATDir(child, relPath, hash); err != nil {
+				return err
+			}
+		}
+		dir.children = append(dir.children, child)
+	}
+	return nil
+}
+
+// planFAT lays out a FAT32 volume for the tree with at least extra bytes
+// of free space. A clusterSize of 0 picks one for the volume size.
+func planFAT(root *fatNode, label string, extra int64, serial uint32, clusterSize int64) (*fatVolume, error) {
+	vol := &fatVolume{root: root, label: label, serial: serial, clusterSize: clusterSize}
+
+	// Names first, since long names change directory sizes
+	assignShortNames(root)
+
+	// Pick the cluster size Windows would use for a volume of this size
+	estimate := vol.countClusters(root, 4096)*4096 + extra
+	switch {
+	case vol.clusterSize != 0:
+	case estimate <= 8<<30:
+		vol.clusterSize = 4096
+	case estimate <= 16<<30:
+		vol.clusterSize = 8192
+	case estimate <= 32<<30:
+		vol.clusterSize = 16384
+	default:
+		vol.clusterSize = 32768
+	}
+
+	vol.usedClusters = uint32(vol.countClusters(root, vol.clusterSize))
+	vol.totalClusters = vol.usedClusters + uint32((extra+vol.clusterSize-1)/vol.clusterSize)
+	if vol.totalClusters < fatMinClusters {
+		vol.totalClusters = fatMinClusters
+	}
+
+	vol.fatSectors = uint32((int64(vol.totalClusters)+2)*4+fatSectorSize-1) / fatSectorSize
+	sectorsPerCluster := uint32(vol.clusterSize / fatSectorSize)
+
+	// Align the data region to a cluster boundary
+	vol.reserved = fatReservedSectors
+	for (vol.reserved+2*vol.fatSectors)%sectorsPerCluster != 0 {
+		vol.reserved++
+	}
+
+	total := int64(vol.reserved) + 2*int64(vol.fatSectors) + int64(vol.totalClusters)*int64(sectorsPerCluster)
+	if total > 0xffffffff {
+		return nil, fmt.Errorf("directory too large for a FAT32 volume")
+	}
+	vol.totalSectors = uint32(total)
+
+	// Lay out clusters contiguously, root directory first
+	next := uint32(2)
+	var assign func(node *fatNode)
+	assign = func(node *fatNode) {
+		if node.clusters > 0 {
+			node.cluster = next
+			next += node.clusters
+		}
+		for _, child := range node.children {
+			if !child.dir {
+				child.cluster = next
+				next += child.clusters
+				if child.clusters == 0 {
+					child.cluster = 0
+				}
+			}
+		}
+		for _, child := range node.children {
+			if child.dir {
+				assign(child)
+			}
+		}
+	}
+	assign(root)
+
+	return vol, nil
+}
+
+// countClusters sets the cluster counts of the tree for a cluster size
+// and returns the total
+func (v *fatVolume) countClusters(node *fatNode, clusterSize int64) int64 {
+	v.files = 0
+	v.bytes = 0
+	var walk func(node *fatNode, root bool) int64
+	walk = func(node *fatNode, root bool) int64 {
+		bytes := int64(fatDirEntryCount(node, root)) * fatEntrySize
+		node.clusters = uint32((bytes + clusterSize - 1) / clusterSize)
+		total := int64(node.clusters)
+		for _, child := range node.children {
+			if child.dir {
+				total += walk(child, false)
+				continue
+			}
+			child.clusters = uint32((child.size + clusterSize - 1) / clusterSize)
+			total += int64(child.clusters)
+			v.files++
+			v.bytes += child.size
+		}
+		return total
+	}
+	return walk(node, true)
+}
+
+// fatDirEntryCount returns the number of 32-byte entries in a directory
+func fatDirEntryCount(dir *fatNode, root bool) int {
+	count := 2 // "." and ".."
+	if root {
+		count = 1 // volume label
+	}
+	for _, child := range dir.children {
+		count++
+		if child.lfn {
+			count += fatLFNEntryCount(child.name)
+		}
+	}
+	return count
+}
+
+func fatLFNEntryCount(name string) int {
+	return (len(utf16.Encode([]rune(name))) + 12) / 13
+}
+
+// assignShortNames gives every node a unique 8.3 name within its directory
+func assignShortNames(dir *fatNode) {
+	used := map[string]bool{}
+	for _, child := range dir.children {
+		child.short, child.lfn = fatShortName(child.name, used)
+		used[string(child.short[:])] = true
+		if child.dir {
+			assignShortNames(child)
+		}
+	}
+}
+
+// fatShortName derives an unused 8.3 name and reports whether a long name
+// entry is needed to preserve the original name
+func fatShortName(name string, used map[string]bool) ([11]byte, bool) {
+	var short [11]byte
+	for i := range short {
+		short[i] = ' '
+	}
+
+	upper := strings.ToUpper(name)
+	base, ext := upper, ""
+	if i := strings.LastIndex(upper, "."); i > 0 {
+		base, ext = upper[:i], upper[i+1:]
+	}
+
+	// Names that are already valid upper case 8.3 are stored as-is
+	if name == upper && len(base) <= 8 && len(ext) <= 3 && fatValidShort(base) && fatValidShort(ext) && base != "" {
+		copy(short[:8], base)
+		copy(short[8:], ext)
+		if !used[string(short[:])] {
+			return short, false
+		}
+	}
+
+	base = fatSanitize(strings.TrimLeft(base, ". "))
+	ext = fatSanitize(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		stem := base
+		if len(stem) > 8-len(tail) {
+			stem = stem[:8-len(tail)]
+		}
+		for i := range short {
+			short[i] = ' '
+		}
+		copy(short[:8], stem+tail)
+		copy(short[8:], ext)
+		if !used[string(short[:])] {
+			return short, true
+		}
+	}
+}
+
+func fatValidShort(s string) bool {
+	for _, r := range s {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(fatShortChars, r)) {
+			return false
+		}
+	}
+	return true
+}
+
+func fatSanitize(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == '.':
+			continue
+		case fatValidShort(string(r)):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// fatLabel converts a name into an 11 character volume label
+func fatLabel(name string) string {
+	label := strings.ToUpper(name)
+	var b strings.Builder
+	for _, r := range label {
+		if b.Len() == 11 {
+			break
+		}
+		if r == ' ' || fatValidShort(string(r)) {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return "USBDRIVE"
+	}
+	return b.String()
+}
+
+// writeFAT writes the planned volume into out, copying file contents from
+// their source paths
+func (v *fatVolume) write(out *os.File) error {
+	if err := out.Truncate(v.offset + int64(v.totalSectors)*fatSectorSize); err != nil {
+		return err
+	}
+
+	boot := v.bootSector()
+	fsinfo := v.fsInfo()
+	for _, sector := range []uint32{0, 6} {
+		if _, err := out.WriteAt(boot, v.offset+int64(sector)*fatSectorSize); err != nil {
+			return fmt.Errorf("write boot sector: %w", err)
+		}
+		if _, err := out.WriteAt(fsinfo, v.offset+int64(sector+1)*fatSectorSize); err != nil {
+			return fmt.Errorf("write FSInfo: %w", err)
+		}
+	}
+
+	table := make([]byte, int64(v.fatSectors)*fatSectorSize)
+	binary.LittleEndian.PutUint32(table[0:], 0x0ffffff8)
+	binary.LittleEndian.PutUint32(table[4:], fatEOC)
+	var chain func(node *fatNode)
+	chain = func(node *fatNode) {
+		for i := uint32(0); i < node.clusters; i++ {
+			next := uint32(fatEOC)
+			if i+1 < node.clusters {
+				next = node.cluster + i + 1
+			}
+			binary.LittleEndian.PutUint32(table[(node.cluster+i)*4:], next)
+		}
+		for _, child := range node.children {
+			chain(child)
+		}
+	}
+	chain(v.root)
+	for copyIndex := uint32(0); copyIndex < 2; copyIndex++ {
+		offset := v.offset + int64(v.reserved+copyIndex*v.fatSectors)*fatSectorSize
+		if _, err := out.WriteAt(table, offset); err != nil {
+			return fmt.Errorf("write FAT: %w", err)
+		}
+	}
+
+	progress := newProgress("Building FAT image", v.bytes)
+	defer progress.Done()
+	return v.writeDir(out, v.root, nil, progress)
+}
+
+func (v *fatVolume) writeDir(out *os.File, dir, parent *fatNode, progress *progress) error {
+	entries := make([]byte, 0, int64(dir.clusters)*v.clusterSize)
+	if parent == nil {
+		var label [11]byte
+		copy(label[:], fmt.Sprintf("%-11s", v.label))
+		entries = append(entries, fatShortEntry(label, fatAttrVolumeID, 0, 0, dir.modTime, dir.accTime)...)
+	} else {
+		var dot, dotdot [11]byte
+		copy(dot[:], ".          ")
+		copy(dotdot[:], "..         ")
+		parentCluster := parent.cluster
+		if parent == v.root {
+			parentCluster = 0
+		}
+		entries = append(entries, fatShortEntry(dot, fatAttrDir, dir.cluster, 0, dir.modTime, dir.accTime)...)
+		entries = append(entries, fatShortEntry(dotdot, fatAttrDir, parentCluster, 0, parent.modTime, parent.accTime)...)
+	}
+
+	for _, child := range dir.children {
+		if child.lfn {
+			entries = append(entries, fatLFNEntries(child.name, fatChecksum(child.short))...)
+		}
+		attr := byte(fatAttrArchive)
+		size := uint32(child.size)
+		if child.dir {
+			attr = fatAttrDir
+			size = 0
+		}
+		entries = append(entries, fatShortEntry(child.short, attr, child.cluster, size, child.modTime, child.accTime)...)
+	}
+
+	if _, err := out.WriteAt(entries, v.clusterOffset(dir.cluster)); err != nil {
+		return fmt.Errorf("write directory %s: %w", dir.source, err)
+	}
+
+	for _, child := range dir.children {
+		if child.dir {
+			if err := v.writeDir(out, child, dir, progress); err != nil {
+				return err
+			}
+			continue
+		}
+		if child.size == 0 {
+			continue
+		}
+		if err := v.writeFile(out, child, progress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *fatVolume) writeFile(out *os.File, node *fatNode, progress *progress) error {
+	file, err := os.Open(node.source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	src := io.TeeReader(io.LimitReader(file, node.size), progress)
+	written, err := copySparseAt(out, v.clusterOffset(node.cluster), src)
+	if err != nil {
+		return fmt.Errorf("copy %s: %w", node.source, err)
+	}
+	if written != node.size {
+		return fmt.Errorf("file changed while building image: %s", node.source)
+	}
+	return nil
+}
+
+func (v *fatVolume) clusterOffset(cluster uint32) int64 {
+	dataStart := v.offset + int64(v.reserved+2*v.fatSectors)*fatSectorSize
+	return dataStart + int64(cluster-2)*v.clusterSize
+}
+
+func (v *fatVolume) bootSector() []byte {
+	b := make([]byte, fatSectorSize)
+	le := binary.LittleEndian
+	copy(b[0:], []byte{0xeb, 0x58, 0x90})
+	copy(b[3:], "MSWIN4.1")
+	le.PutUint16(b[11:], fatSectorSize)
+	b[13] = byte(v.clusterSize / fatSectorSize)
+	le.PutUint16(b[14:], uint16(v.reserved))
+	b[16] = 2    // number of FATs
+	b[21] = 0xf8 // fixed media
+	le.PutUint16(b[24:], 63)
+	le.PutUint16(b[26:], 255)
+	le.PutUint32(b[28:], uint32(v.offset/fatSectorSize)) // hidden sectors
+	le.PutUint32(b[32:], v.totalSectors)
+	le.PutUint32(b[36:], v.fatSectors)
+	le.PutUint32(b[44:], 2) // root directory cluster
+	le.PutUint16(b[48:], 1) // FSInfo sector
+	le.PutUint16(b[50:], 6) // backup boot sector
+	b[64] = 0x80
+	b[66] = 0x29
+	le.PutUint32(b[67:], v.serial)
+	copy(b[71:], fmt.Sprintf("%-11s", v.label))
+	copy(b[82:], "FAT32   ")
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func (v *fatVolume) fsInfo() []byte {
+	b := make([]byte, fatSectorSize)
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], 0x41615252)
+	le.PutUint32(b[484:], 0x61417272)
+	le.PutUint32(b[488:], v.totalClusters-v.usedClusters)
+	le.PutUint32(b[492:], v.usedClusters+2)
+	le.PutUint32(b[508:], 0xaa550000)
+	return b
+}
+
+func fatShortEntry(name [11]byte, attr byte, cluster, size uint32, mod, acc time.Time) []byte {
+	b := make([]byte, fatEntrySize)
+	le := binary.LittleEndian
+	copy(b[0:], name[:])
+	b[11] = attr
+	modDate, modTime, tenths := fatTimestamp(mod)
+	accDate, _, _ := fatTimestamp(acc)
+	b[13] = tenths
+	le.PutUint16(b[14:], modTime)
+	le.PutUint16(b[16:], modDate)
+	le.PutUint16(b[18:], accDate)
+	le.PutUint16(b[20:], uint16(cluster>>16))
+	le.PutUint16(b[22:], modTime)
+	le.PutUint16(b[24:], modDate)
+	le.PutUint16(b[26:], uint16(cluster))
+	le.PutUint32(b[28:], size)
+	return b
+}
+
+// fatLFNEntries encodes a long name as VFAT entries in on-disk order
+func fatLFNEntries(name string, checksum byte) []byte {
+	units := utf16.Encode([]rune(name))
+	count := (len(units) + 12) / 13
+	if len(units)%13 != 0 {
+		units = append(units, 0)
+		for len(units)%13 != 0 {
+			units = append(units, 0xffff)
+		}
+	}
+
+	// Character slots within an entry
+	slots := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+	out := make([]byte, 0, count*fatEntrySize)
+	for seq := count; seq >= 1; seq-- {
+		b := make([]byte, fatEntrySize)
+		b[0] = byte(seq)
+		if seq == count {
+			b[0] |= 0x40
+		}
+		b[11] = fatAttrLFN
+		b[13] = checksum
+		for i, slot := range slots {
+			binary.LittleEndian.PutUint16(b[slot:], units[(seq-1)*13+i])
+		}
+		out = append(out, b...)
+	}
+	return out
+}
+
+func fatChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// fatTimestamp converts a time into FAT date, time and 10ms units
+func fatTimestamp(t time.Time) (uint16, uint16, byte) {
+	t = t.Local()
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0, 0
+	}
+	if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, time.Local)
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	clock := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	tenths := byte(t.Second()%2*100 + t.Nanosecond()/10000000)
+	return date, clock, tenths
+}
+
+// accessTime returns the last access time of a file, or its mtime if the
+// platform does not report one
+func accessTime(info os.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	}
+	return info.ModTime()
+}
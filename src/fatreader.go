@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// fatEntry is a file or directory found while reading a FAT32 volume
+type fatEntry struct {
+	path    string // slash separated, relative to the root
+	dir     bool
+	size    int64
+	cluster uint32
+	date    uint16
+	time    uint16
+}
+
+// modTime returns the entry's last write time
+func (e *fatEntry) modTime() time.Time {
+	return fatTime(e.date, e.time)
+}
+
+// fatMaxEntries bounds how many entries a sync reads back, so a corrupt
+// tree can't keep unmount busy
+const fatMaxEntries = 1 << 20
+
+// fatReader reads files back out of a FAT32 volume
+type fatReader struct {
+	file        *os.File
+	clusterSize int64
+	dataStart   int64
+	rootCluster uint32
+	table       []uint32
+}
+
+// openFAT parses the boot sector and FAT of a FAT32 volume
+func openFAT(path string) (*fatReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	boot := make([]byte, fatSectorSize)
+	if _, err := file.ReadAt(boot, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read boot sector: %w", err)
+	}
+
+	le := binary.LittleEndian
+	sectorSize := int64(le.Uint16(boot[11:]))
+	sectorsPerCluster := int64(boot[13])
+	reserved := int64(le.Uint16(boot[14:]))
+	fats := int64(boot[16])
+	fatSectors := int64(le.Uint32(boot[36:]))
+	totalSectors := int64(le.Uint32(boot[32:]))
+	notFAT32 := fmt.Errorf("not a FAT32 volume (was the drive reformatted?)")
+	if boot[510] != 0x55 || boot[511] != 0xaa || !bytes.Equal(boot[82:87], []byte("FAT32")) ||
+		sectorSize < 512 || sectorsPerCluster == 0 || fats == 0 || fatSectors == 0 {
+		file.Close()
+		return nil, notFAT32
+	}
+
+	r := &fatReader{
+		file:        file,
+		clusterSize: sectorSize * sectorsPerCluster,
+		dataStart:   (reserved + fats*fatSectors) * sectorSize,
+		rootCluster: le.Uint32(boot[44:]),
+	}
+
+	// A damaged boot sector can put the data area past the end of the
+	// volume or the root outside it
+	if r.dataStart >= totalSectors*sectorSize {
+		file.Close()
+		return nil, notFAT32
+	}
+	clusters := (totalSectors*sectorSize-r.dataStart)/r.clusterSize + 2
+	if limit := fatSectors * sectorSize / 4; clusters > limit {
+		clusters = limit
+	}
+	if clusters < 3 || int64(r.rootCluster) < 2 || int64(r.rootCluster) >= clusters {
+		file.Close()
+		return nil, notFAT32
+	}
+	if err := checkTable(file, "FAT", reserved*sectorSize, clusters*4); err != nil {
+		file.Close()
+		return nil, err
+	}
+	raw := make([]byte, clusters*4)
+	if _, err := file.ReadAt(raw, reserved*sectorSize); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read FAT: %w", err)
+	}
+	r.table = make([]uint32, clusters)
+	for i := range r.table {
+		r.table[i] = le.Uint32(raw[i*4:]) & 0x0fffffff
+	}
+	return r, nil
+}
+
+func (r *fatReader) Close() error {
+	return r.file.Close()
+}
+
+// chain returns the clusters of the chain starting at cluster
+func (r *fatReader) chain(cluster uint32) ([]uint32, error) {
+	var clusters []uint32
+	for cluster >= 2 && cluster < 0x0ffffff8 {
+		if int(cluster) >= len(r.table) || len(clusters) >= len(r.table) {
+			return nil, fmt.Errorf("corrupt cluster chain at %d", cluster)
+		}
+		clusters = append(clusters, cluster)
+		cluster = r.table[cluster]
+	}
+	return clusters, nil
+}
+
+// copyFile writes the contents of a file entry to w
+func (r *fatReader) copyFile(entry *fatEntry, w io.Writer) error {
+	clusters, err := r.chain(entry.cluster)
+	if err != nil {
+		return err
+	}
+	if int64(len(clusters))*r.clusterSize < entry.size {
+		return fmt.Errorf("cluster chain shorter than file size: %s", entry.path)
+	}
+
+	remaining := entry.size
+	buf := make([]byte, r.clusterSize)
+	for _, cluster := range clusters {
+		if remaining == 0 {
+			break
+		}
+		n := r.clusterSize
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := r.file.ReadAt(buf[:n], r.dataStart+int64(cluster-2)*r.clusterSize); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// walk lists every file and directory of the volume, parents first
+func (r *fatReader) walk() ([]fatEntry, error) {
+	var entries []fatEntry
+	// The host may have written directories that loop back on themselves
+	visited := map[uint32]bool{}
+	var walkDir func(cluster uint32, dir string, depth int) error
+	walkDir = func(cluster uint32, dir string, depth int) error {
+		if depth > 64 {
+			return fmt.Errorf("directory tree too deep at %s", dir)
+		}
+		if visited[cluster] {
+			return fmt.Errorf("directory %s loops back to cluster %d", dir, cluster)
+		}
+		visited[cluster] = true
+		children, err := r.readDir(cluster, dir)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, children...)
+		if len(entries) > fatMaxEntries {
+			return fmt.Errorf("more than %d entries in the drive", fatMaxEntries)
+		}
+		for _, child := range children {
+			if child.dir {
+				if err := walkDir(child.cluster, child.path, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walkDir(r.rootCluster, "", 0); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readDir decodes the entries of one directory, joining long names
+func (r *fatReader) readDir(cluster uint32, dir string) ([]fatEntry, error) {
+	clusters, err := r.chain(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	var entries []fatEntry
+	var lfn []uint16
+	var lfnSum byte
+	buf := make([]byte, r.clusterSize)
+	for _, c := range clusters {
+		if _, err := r.file.ReadAt(buf, r.dataStart+int64(c-2)*r.clusterSize); err != nil {
+			return nil, fmt.Errorf("read directory %s: %w", dir, err)
+		}
+		for off := 0; off < len(buf); off += fatEntrySize {
+			e := buf[off : off+fatEntrySize]
+			if e[0] == 0x00 {
+				return entries, nil
+			}
+			if e[0] == 0xe5 {
+				lfn = nil
+				continue
+			}
+
+			if e[11]&0x3f == fatAttrLFN {
+				// Long name parts are stored last part first
+				if e[0]&0x40 != 0 {
+					lfn = nil
+				}
+				var part []uint16
+				for _, slot := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					part = append(part, le.Uint16(e[slot:]))
+				}
+				lfn = append(part, lfn...)
+				lfnSum = e[13]
+				continue
+			}
+			if e[11]&fatAttrVolumeID != 0 {
+				lfn = nil
+				continue
+			}
+
+			var short [11]byte
+			copy(short[:], e[:11])
+			if short[0] == 0x05 {
+				short[0] = 0xe5
+			}
+			name := fatDisplayName(short, e[12])
+			if lfn != nil && lfnSum == fatChecksum(short) {
+				name = fatDecodeLFN(lfn)
+			}
+			lfn = nil
+			if name == "." || name == ".." {
+				continue
+			}
+
+			entries = append(entries, fatEntry{
+				path:    path.Join(dir, name),
+				dir:     e[11]&fatAttrDir != 0,
+				size:    int64(le.Uint32(e[28:])),
+				cluster: uint32(le.Uint16(e[20:]))<<16 | uint32(le.Uint16(e[26:])),
+				time:    le.Uint16(e[22:]),
+				date:    le.Uint16(e[24:]),
+			})
+			if entries[len(entries)-1].dir {
+				entries[len(entries)-1].size = 0
+			}
+		}
+	}
+	return entries, nil
+}
+
+// fatDisplayName formats an 8.3 name, applying the lower case flags
+// Windows and Linux set in the reserved byte
+func fatDisplayName(short [11]byte, flags byte) string {
+	base := strings.TrimRight(string(short[:8]), " ")
+	ext := strings.TrimRight(string(short[8:]), " ")
+	if flags&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if flags&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+func fatDecodeLFN(units []uint16) string {
+	for i, u := range units {
+		if u == 0 {
+			units = units[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// fatTime converts a FAT date and time into a local time
+func fatTime(date, clock uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0x0f), int(date&0x1f),
+		int(clock>>11), int(clock>>5&0x3f), int(clock&0x1f)*2, 0, time.Local)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// applyDescriptors puts back the descriptors a previous mount changed and
+// writes those of want, saving the values it replaces in the state. The
+// gadget must be unbound from its UDC.
+func applyDescriptors(gadgetRoot string, want *GadgetConfig) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if state.Descriptors == nil && want == nil {
+		return nil
+	}
+
+	if state.Descriptors != nil {
+		logger.Info("Restoring gadget descriptors")
+		for _, field := range gadgetFields {
+			if value := *field.value(state.Descriptors); value != "" {
+				if err := writeFile(filepath.Join(gadgetRoot, field.file), value); err != nil {
+					return fmt.Errorf("restore %s: %w", field.key, err)
+				}
+			}
+		}
+		state.Descriptors = nil
+	}
+
+	if want != nil {
+		// Save the originals before writing so they survive a failure
+		original := &GadgetConfig{}
+		for _, field := range gadgetFields {
+			if *field.value(want) == "" {
+				continue
+			}
+			current, err := readFile(filepath.Join(gadgetRoot, field.file))
+			if err != nil {
+				return fmt.Errorf("read %s: %w", field.key, err)
+			}
+			*field.value(original) = current
+		}
+		state.Descriptors = original
+		if err := state.save(); err != nil {
+			return fmt.Errorf("record gadget descriptors: %w", err)
+		}
+		for _, field := range gadgetFields {
+			value := *field.value(want)
+			if value == "" {
+				continue
+			}
+			logger.Info("Setting gadget descriptor", "name", field.key, "value", value)
+			if err := writeFile(filepath.Join(gadgetRoot, field.file), value); err != nil {
+				return fmt.Errorf("set %s: %w", field.key, err)
+			}
+		}
+	}
+	return state.save()
+}
+
+// setLUNAttributes writes the attributes of a LUN, putting unset ones back
+// to the kernel defaults so those of a previous mount don't linger. The LUN
+// must have no file attached.
+func setLUNAttributes(lunRoot string, attrs LUNAttributes) error {
+	values := []struct {
+		file  string
+		set   bool
+		value string
+	}{
+		{"removable", attrs.Removable != nil, boolAttr(attrs.Removable, true)},
+		{"nofua", attrs.NoFUA != nil, boolAttr(attrs.NoFUA, false)},
+		{"inquiry_string", attrs.Inquiry != "", attrs.Inquiry},
+	}
+	for _, attr := range values {
+		path := filepath.Join(lunRoot, attr.file)
+		current, err := readFile(path)
+		if err != nil {
+			if attr.set {
+				return fmt.Errorf("the kernel does not support the %s attribute: %w", attr.file, err)
+			}
+			continue
+		}
+		if current == attr.value {
+			continue
+		}
+		logger.Info("Setting LUN attribute", "lun", filepath.Base(lunRoot), "name", attr.file, "value", attr.value)
+		if err := writeFile(path, attr.value); err != nil {
+			return fmt.Errorf("set %s: %w", attr.file, err)
+		}
+	}
+	return nil
+}
+
+// boolAttr formats an optional flag as a sysfs attribute value
+func boolAttr(value *bool, fallback bool) string {
+	if value != nil {
+		fallback = *value
+	}
+	if fallback {
+		return "1"
+	}
+	return "0"
+}
+
+// readLUNAttributes reads the attributes of a LUN the kernel has. Removable
+// is always set, nofua only when on.
+func readLUNAttributes(lunRoot string) LUNAttributes {
+	var attrs LUNAttributes
+	if value, err := readFile(filepath.Join(lunRoot, "removable")); err == nil {
+		removable := value == "1"
+		attrs.Removable = &removable
+	}
+	if value, err := readFile(filepath.Join(lunRoot, "nofua")); err == nil && value == "1" {
+		nofua := true
+		attrs.NoFUA = &nofua
+	}
+	attrs.Inquiry, _ = readFile(filepath.Join(lunRoot, "inquiry_string"))
+	return attrs
+}
+
+// readDescriptors reads the USB descriptors the gadget presents now
+func readDescriptors(gadgetRoot string) (*GadgetConfig, error) {
+	gadget := &GadgetConfig{}
+	for _, field := range gadgetFields {
+		value, err := readFile(filepath.Join(gadgetRoot, field.file))
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", field.key, err)
+		}
+		*field.value(gadget) = value
+	}
+	return gadget, nil
+}
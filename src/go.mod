@@ -2,7 +2,11 @@ module usbdrive
 
 go 1.21
 
-require github.com/spf13/cobra v1.10.1
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/spf13/cobra v1.10.1
+	github.com/ulikunitz/xz v0.5.17
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
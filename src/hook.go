@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// runHook runs a hook command of a profile with sh. USBDRIVE_HOOK names the
+// hook, env adds details such as the profile and image.
+func runHook(name, command string, env map[string]string) error {
+	if command == "" {
+		return nil
+	}
+	logger.Info("Running hook", "hook", name, "command", command)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "USBDRIVE_HOOK="+name)
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook: %w", name, err)
+	}
+	return nil
+}
+
+// recordUnmountHook remembers the hook umount runs for the mounted profile
+func recordUnmountHook(command string) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if state.UnmountHook == command {
+		return nil
+	}
+	state.UnmountHook = command
+	return state.save()
+}
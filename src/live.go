@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// liveFlavor is how a live system finds its persistence filesystem
+type liveFlavor struct {
+	name  string
+	label string
+	conf  bool   // needs a persistence.conf in the filesystem root
+	param string // kernel parameter that enables persistence
+}
+
+var (
+	casperFlavor   = liveFlavor{name: "casper", label: "casper-rw", param: "persistent"}
+	liveBootFlavor = liveFlavor{name: "live-boot", label: "persistence", conf: true, param: "persistence"}
+)
+
+// mke2fsPaths are where the ext4 formatter lives on Linux and Android
+var mke2fsPaths = []string{"mke2fs", "mkfs.ext4", "/system/bin/mke2fs"}
+
+// isoRootNames lists the root directory of an ISO9660 image, lowercased
+// and without version suffixes
+func isoRootNames(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pvd := make([]byte, isoSectorSize)
+	if _, err := file.ReadAt(pvd, isoDescriptorOff); err != nil {
+		return nil, fmt.Errorf("read volume descriptor: %w", err)
+	}
+	if pvd[0] != 1 || !bytes.Equal(pvd[1:6], isoMagic) {
+		return nil, fmt.Errorf("not an ISO9660 image")
+	}
+	root := pvd[156:]
+	extent := int64(binary.LittleEndian.Uint32(root[2:]))
+	size := binary.LittleEndian.Uint32(root[10:])
+	if size > 1<<20 {
+		return nil, fmt.Errorf("root directory too large: %d bytes", size)
+	}
+
+	dir := make([]byte, size)
+	if _, err := file.ReadAt(dir, extent*isoSectorSize); err != nil {
+		return nil, fmt.Errorf("read root directory: %w", err)
+	}
+	var names []string
+	for pos := 0; pos < len(dir); {
+		length := int(dir[pos])
+		if length == 0 {
+			// Records never cross sectors, the rest of this one is padding
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if pos+length > len(dir) || length < 34 {
+			break
+		}
+		nameLen := int(dir[pos+32])
+		if 33+nameLen > length {
+			// The name runs past its record, skip the damaged record
+			pos += length
+			continue
+		}
+		name := string(dir[pos+33 : pos+33+nameLen])
+		if name != "\x00" && name != "\x01" {
+			name, _, _ = strings.Cut(name, ";")
+			names = append(names, strings.ToLower(strings.TrimSuffix(name, ".")))
+		}
+		pos += length
+	}
+	return names, nil
+}
+
+// detectLiveFlavor tells Ubuntu's casper from Debian's live-boot by the
+// directory holding the live filesystem
+func detectLiveFlavor(iso string) (*liveFlavor, error) {
+	names, err := isoRootNames(iso)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		switch name {
+		case "casper":
+			return &casperFlavor, nil
+		case "live":
+			return &liveBootFlavor, nil
+		}
+	}
+	return nil, fmt.Errorf("no casper or live directory in the ISO\nHint: Use --label to set the persistence label the live system expects")
+}
+
+// flavorForLabel returns the flavor matching an explicit label
+func flavorForLabel(label string) *liveFlavor {
+	switch label {
+	case casperFlavor.label, "writable":
+		flavor := casperFlavor
+		flavor.label = label
+		return &flavor
+	case liveBootFlavor.label:
+		return &liveBootFlavor
+	}
+	return &liveFlavor{name: "custom", label: label}
+}
+
+// persistencePath is where the persistence image of an ISO is kept by default
+func persistencePath(iso string, flavor *liveFlavor) string {
+	name := strings.TrimSuffix(filepath.Base(iso), filepath.Ext(iso))
+	return filepath.Join(stateDir, "persistence", name+"-"+flavor.label+".img")
+}
+
+// createPersistence formats a sparse ext4 image with the flavor's label and,
+// for live-boot, a persistence.conf that keeps the whole root filesystem
+func createPersistence(path string, size int64, flavor *liveFlavor) error {
+	var mke2fs string
+	for _, candidate := range mke2fsPaths {
+		if found, err := exec.LookPath(candidate); err == nil {
+			mke2fs = found
+			break
+		}
+	}
+	if mke2fs == "" {
+		return fmt.Errorf("mke2fs not found\nHint: Install e2fsprogs or create the image elsewhere and pass it with --persistence-file")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	file.Close()
+	if err == nil {
+		logger.Info("Formatting persistence image", "path", path, "label", flavor.label, "mke2fs", mke2fs)
+		var output []byte
+		output, err = exec.Command(mke2fs, "-t", "ext4", "-F", "-q", "-L", flavor.label, path).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("mke2fs: %w: %s", err, strings.TrimSpace(string(output)))
+		}
+	}
+	if err == nil && flavor.conf {
+		err = writePersistenceConf(path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// writePersistenceConf mounts the new filesystem briefly to add the
+// persistence.conf live-boot requires
+func writePersistenceConf(image string) error {
+	loop, err := attachLoop(image, 0, 0, false)
+	if err != nil {
+		return err
+	}
+	defer detachLoop(*loop)
+
+	// Android has no /tmp, the state directory is always writable by root
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	dir, err := os.MkdirTemp(stateDir, "mnt-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	if err := syscall.Mount(loop.Device, dir, "ext4", 0, ""); err != nil {
+		return fmt.Errorf("mount persistence image: %w", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "persistence.conf"), []byte("/ union\n"), 0644)
+	if unmountErr := syscall.Unmount(dir, 0); err == nil && unmountErr != nil {
+		err = fmt.Errorf("unmount persistence image: %w", unmountErr)
+	}
+	return err
+}
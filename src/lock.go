@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// defaultLockTimeout is how long a command waits for another usbdrive
+const defaultLockTimeout = 30 * time.Second
+
+// lockTimeout is set by the --lock-timeout flag of mutating commands
+var lockTimeout = defaultLockTimeout
+
+// acquireLock takes the lock that serializes usbdrive invocations touching
+// the gadget or the state, waiting up to timeout for the holder to finish.
+// The lock is released by the returned function or when the process exits.
+func acquireLock(timeout time.Duration) (func(), error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("create state dir: %w", err)
+	}
+	path := filepath.Join(stateDir, "lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if time.Now().After(deadline) {
+			holder := "another process"
+			if pid, err := lockHolder(file); err == nil {
+				holder = fmt.Sprintf("PID %d", pid)
+			}
+			file.Close()
+			return nil, fmt.Errorf("another usbdrive command is running (%s)\nHint: Wait for it to finish, or raise --lock-timeout", holder)
+		}
+		if !waiting {
+			logger.Info("Waiting for another usbdrive command", "lock", path)
+			waiting = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Record the holder for the error message of the next waiter
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() {
+		file.Truncate(0)
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// lockHolder returns the PID recorded in the lock file
+func lockHolder(file *os.File) (int, error) {
+	buf := make([]byte, 32)
+	n, err := file.ReadAt(buf, 0)
+	if n == 0 {
+		return 0, fmt.Errorf("no PID recorded: %w", err)
+	}
+	for n > 0 && (buf[n-1] == '\n' || buf[n-1] == 0) {
+		n--
+	}
+	return strconv.Atoi(string(buf[:n]))
+}
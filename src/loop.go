@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	loopSetFD       = 0x4C00
+	loopClrFD       = 0x4C01
+	loopSetStatus64 = 0x4C04
+	loopGetStatus64 = 0x4C05
+	loopConfigure   = 0x4C0A
+	loopCtlGetFree  = 0x4C82
+
+	loFlagsReadOnly = 1
+	loopMajor       = 7
+)
+
+// loopInfo64 mirrors struct loop_info64 from <linux/loop.h>
+type loopInfo64 struct {
+	Device         uint64
+	Inode          uint64
+	Rdevice        uint64
+	Offset         uint64
+	SizeLimit      uint64
+	Number         uint32
+	EncryptType    uint32
+	EncryptKeySize uint32
+	Flags          uint32
+	FileName       [64]byte
+	CryptName      [64]byte
+	EncryptKey     [32]byte
+	Init           [2]uint64
+}
+
+// loopConfig mirrors struct loop_config from <linux/loop.h>
+type loopConfig struct {
+	FD        uint32
+	BlockSize uint32
+	Info      loopInfo64
+	Reserved  [8]uint64
+}
+
+// LoopDevice is a loop device attached by usbdrive
+type LoopDevice struct {
+	Device    string `json:"device"`
+	Backing   string `json:"backing"`
+	Inode     uint64 `json:"inode"`
+	Offset    int64  `json:"offset,omitempty"`
+	SizeLimit int64  `json:"sizelimit,omitempty"`
+}
+
+// attachLoop binds a free loop device to a byte range of backing. A zero
+// sizeLimit extends the range to the end of the file.
+func attachLoop(backing string, offset, sizeLimit int64, readOnly bool) (*LoopDevice, error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	file, err := os.OpenFile(backing, flags, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open backing file: %w", err)
+	}
+	defer file.Close()
+
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open loop-control: %w", err)
+	}
+	defer ctl.Close()
+
+	// Another process may grab the free device first, so retry
+	var lastErr error
+	for attempt := 0; attempt < 5; attempt++ {
+		number, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ctl.Fd(), loopCtlGetFree, 0)
+		if errno != 0 {
+			return nil, fmt.Errorf("get free loop device: %w", errno)
+		}
+
+		device, err := loopDevicePath(int(number))
+		if err != nil {
+			return nil, err
+		}
+
+		lastErr = configureLoop(device, file, offset, sizeLimit, readOnly)
+		if lastErr == syscall.EBUSY {
+			logger.Info("Loop device busy, retrying", "device", device)
+			continue
+		}
+		if lastErr != nil {
+			return nil, fmt.Errorf("configure %s: %w", device, lastErr)
+		}
+
+		var inode uint64
+		if info, err := file.Stat(); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				inode = st.Ino
+			}
+		}
+
+		logger.Info("Attached loop device", "device", device, "backing", backing, "offset", offset, "sizelimit", sizeLimit)
+		return &LoopDevice{Device: device, Backing: backing, Inode: inode, Offset: offset, SizeLimit: sizeLimit}, nil
+	}
+	return nil, fmt.Errorf("no free loop device: %w", lastErr)
+}
+
+func configureLoop(device string, backing *os.File, offset, sizeLimit int64, readOnly bool) error {
+	dev, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	info := loopInfo64{
+		Offset:    uint64(offset),
+		SizeLimit: uint64(sizeLimit),
+	}
+	if readOnly {
+		info.Flags |= loFlagsReadOnly
+	}
+	copy(info.FileName[:len(info.FileName)-1], backing.Name())
+
+	config := loopConfig{FD: uint32(backing.Fd()), Info: info}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopConfigure, uintptr(unsafe.Pointer(&config)))
+	if errno == 0 {
+		return nil
+	}
+	if errno != syscall.EINVAL && errno != syscall.ENOTTY {
+		return errno
+	}
+
+	// Kernels before 5.8 lack LOOP_CONFIGURE
+	logger.Info("LOOP_CONFIGURE not supported, falling back to LOOP_SET_FD")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopSetFD, backing.Fd()); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopSetStatus64, uintptr(unsafe.Pointer(&info))); errno != 0 {
+		syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopClrFD, 0)
+		return errno
+	}
+	return nil
+}
+
+// loopDevicePath returns the device node for loop device number, creating
+// it if ueventd has not done so yet
+func loopDevicePath(number int) (string, error) {
+	candidates := []string{
+		fmt.Sprintf("/dev/block/loop%d", number),
+		fmt.Sprintf("/dev/loop%d", number),
+	}
+
+	for i := 0; i < 20; i++ {
+		for _, path := range candidates {
+			if pathExists(path) {
+				return path, nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Fall back to creating the node from the sysfs device number
+	devNum, err := readFile(fmt.Sprintf("/sys/block/loop%d/dev", number))
+	if err != nil {
+		return "", fmt.Errorf("loop%d device node not found", number)
+	}
+	majorStr, minorStr, _ := strings.Cut(devNum, ":")
+	major, _ := strconv.Atoi(majorStr)
+	minor, _ := strconv.Atoi(minorStr)
+	if major != loopMajor {
+		return "", fmt.Errorf("unexpected device number %s for loop%d", devNum, number)
+	}
+
+	path := candidates[0]
+	if !dirExists(filepath.Dir(path)) {
+		path = candidates[1]
+	}
+	logger.Info("Creating loop device node", "path", path)
+	dev := minor&0xff | major<<8 | (minor&^0xff)<<12
+	if err := syscall.Mknod(path, syscall.S_IFBLK|0600, dev); err != nil {
+		return "", fmt.Errorf("create %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// detachLoop releases a loop device, but only if it is still bound to the
+// recorded backing file, so a device reused by someone else is left alone
+func detachLoop(loop LoopDevice) error {
+	dev, err := os.OpenFile(loop.Device, os.O_RDONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer dev.Close()
+
+	var info loopInfo64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopGetStatus64, uintptr(unsafe.Pointer(&info)))
+	if errno == syscall.ENXIO {
+		logger.Info("Loop device already detached", "device", loop.Device)
+		return nil
+	}
+	if errno != 0 {
+		return errno
+	}
+	if info.Inode != loop.Inode || int64(info.Offset) != loop.Offset {
+		logger.Info("Loop device no longer bound to image, skipping", "device", loop.Device)
+		return nil
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), loopClrFD, 0)
+	if errno != 0 && errno != syscall.ENXIO {
+		return errno
+	}
+	logger.Info("Detached loop device", "device", loop.Device)
+	return nil
+}
+
+// loopBacking returns the backing file of a loop device, or "" if path is
+// not a bound loop device
+func loopBacking(path string) string {
+	name := filepath.Base(path)
+	if !strings.HasPrefix(name, "loop") {
+		return ""
+	}
+	backing, err := readFile(filepath.Join("/sys/block", name, "loop", "backing_file"))
+	if err != nil {
+		return ""
+	}
+	return backing
+}
+
+// recordLoop adds a loop device to the state so it can be released later
+func recordLoop(loop *LoopDevice) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	state.Loops = append(state.Loops, *loop)
+	return state.save()
+}
+
+// releaseLoops detaches recorded loop devices that are no longer attached
+// to a LUN, including ones left behind by a crashed invocation
+func releaseLoops() error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if len(state.Loops) == 0 {
+		return nil
+	}
+
+	mounted := map[string]bool{}
+	for _, file := range mountedFiles() {
+		mounted[file] = true
+	}
+
+	var kept []LoopDevice
+	var errs []string
+	for _, loop := range state.Loops {
+		if mounted[loop.Device] {
+			kept = append(kept, loop)
+			continue
+		}
+		if err := detachLoop(loop); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", loop.Device, err))
+			kept = append(kept, loop)
+		}
+	}
+
+	state.Loops = kept
+	if err := state.save(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("detach loop devices: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -2,10 +2,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -16,13 +19,71 @@ var (
 	logger *slog.Logger
 
 	// mount flags
-	mountRO      bool
-	mountRW      bool
-	mountCDROM   bool
-	mountForce   string
-	mountVerbose bool
-	mountDryRun  bool
-	mountConfig  string
+	mountRO        bool
+	mountRW        bool
+	mountCDROM     bool
+	mountMode      string
+	mountVerify    bool
+	mountSum       string
+	mountUnpack    bool
+	mountCache     string
+	mountPart      int
+	mountOffset    string
+	mountLimit     string
+	mountBlockDev  bool
+	mountPad       bool
+	mountBusy      bool
+	mountOverlay   bool
+	mountDir       string
+	mountDirFree   string
+	mountCompose   string
+	mountForce     string
+	mountVerbose   bool
+	mountDryRun    bool
+	mountConfig    string
+	mountProfile   string
+	mountWait      string
+	mountRemovable bool
+	mountNoFUA     bool
+	mountInquiry   string
+	mountPersist   bool
+
+	// boot flags
+	bootConfig  string
+	bootProfile string
+	bootTimeout time.Duration
+
+	// status flags
+	statusSaveProfile string
+	statusConfig      string
+
+	// profiles flags
+	profilesConfig string
+
+	// config flags
+	configResolved bool
+
+	// convert flags
+	convertVerbose bool
+
+	// split flags
+	splitSize    string
+	splitVerbose bool
+
+	// live flags
+	livePersistence string
+	livePersistFile string
+	liveLabel       string
+	livePad         bool
+	liveBusy        bool
+	liveDryRun      bool
+	liveVerbose     bool
+
+	// multiboot flags
+	multibootGrub    string
+	multibootFree    string
+	multibootDryRun  bool
+	multibootVerbose bool
 
 	// unmount flags
 	unmountForce   string
@@ -39,7 +100,7 @@ var rootCmd = &cobra.Command{
 	},
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		level := slog.LevelError
-		if mountVerbose || unmountVerbose {
+		if mountVerbose || unmountVerbose || convertVerbose || splitVerbose || multibootVerbose || liveVerbose {
 			level = slog.LevelInfo
 		}
 		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -59,7 +120,7 @@ var versionCmd = &cobra.Command{
 var mountCmd = &cobra.Command{
 	Use:   "mount [flags] <file>",
 	Short: "Mount a disk image as USB device",
-	Long:  "Mount a disk image as USB mass storage device.",
+	Long:  "Mount a disk image as USB mass storage device.\nUse --dir to expose a directory as a FAT32 drive, or --compose to join partition images into one disk.",
 	Args:  cobra.MaximumNArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if os.Geteuid() != 0 {
@@ -69,79 +130,568 @@ var mountCmd = &cobra.Command{
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var imagePath string
+		var modeName string
 		var readWrite, useCDROM bool
 		var forceBackend string
+		var mounted bool
 
-		// Load from config if -c provided
-		if mountConfig != "" {
-			cfg, err := loadConfig(mountConfig)
+		if !mountDryRun {
+			unlock, err := acquireLock(lockTimeout)
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return err
 			}
-			imagePath = cfg.File
-			forceBackend = cfg.Backend
-			
-			switch cfg.Mode {
-			case "ro":
-				readWrite = false
-			case "cdrom":
-				useCDROM = true
-			default:
-				readWrite = true // rw is default
+			defer unlock()
+		}
+
+		// Flags override the environment, which overrides the config
+		settings, err := resolveMountSettings(cmd, args)
+		if err != nil {
+			return err
+		}
+		profile := settings.profile
+		forceBackend = settings.Backend.Value
+		explicitMode := settings.Mode.Source != "default"
+
+		if mountDir != "" && profile != nil {
+			return fmt.Errorf("cannot use --dir with a config profile (conflicting flags)")
+		}
+
+		if mountCompose != "" && (profile != nil || mountDir != "") {
+			return fmt.Errorf("cannot use --compose with a config profile or --dir (conflicting flags)")
+		}
+
+		if profile != nil {
+			imagePath = settings.File.Value
+			modeName = settings.Mode.Value
+			logger.Info("Loaded configuration", "path", settings.Config.Value, "profile", profile.name)
+		} else if mountDir != "" {
+			// Build a FAT drive from a directory
+			if len(args) > 0 {
+				return fmt.Errorf("cannot use --dir with a file argument")
+			}
+			if settings.Mode.Value == "cdrom" {
+				return fmt.Errorf("cannot use --dir with -cdrom (directory drives are FAT32 disks)")
+			}
+			if mountPart != 0 || mountOffset != "" || mountLimit != "" || mountVerify || mountSum != "" {
+				return fmt.Errorf("cannot use --dir with --partition, --offset, --sizelimit or --verify")
+			}
+			modeName = "ro"
+			if explicitMode && settings.Mode.Value == "rw" {
+				modeName = "rw"
 			}
-			
-			logger.Info("Loaded configuration", "path", mountConfig)
 		} else {
 			// Use command line args
-			if len(args) < 1 {
+			if mountCompose != "" {
+				if len(args) > 0 {
+					return fmt.Errorf("cannot use --compose with a file argument")
+				}
+				if settings.Mode.Value == "cdrom" || mountOverlay {
+					return fmt.Errorf("cannot use --compose with -cdrom or --overlay")
+				}
+				if mountPart != 0 || mountOffset != "" || mountLimit != "" || mountVerify || mountSum != "" {
+					return fmt.Errorf("cannot use --compose with --partition, --offset, --sizelimit or --verify")
+				}
+			} else if settings.File.Value == "" {
 				return fmt.Errorf("missing file argument")
+			} else {
+				imagePath = settings.File.Value
+			}
+
+			modeName = settings.Mode.Value
+			if mountOverlay {
+				if modeName != "rw" && modeName != "auto" {
+					return fmt.Errorf("--overlay requires read-write mode (writes go to the overlay)")
+				}
+				modeName = "rw"
+			}
+		}
+
+		// Images on removable storage may show up late during boot, and
+		// volume references only resolve once their volume is mounted
+		deadline := time.Now().Add(settings.wait)
+		waitPath := func(ref string) (string, error) {
+			until := deadline
+			if mountDryRun {
+				until = time.Now()
+			}
+			path := ref
+			var resolveErr error
+			retryBackoff(until, pollInterval, nil, func() error {
+				if isPathRef(ref) {
+					if path, resolveErr = resolvePath(ref); resolveErr != nil {
+						logger.Info("Waiting for volume", "path", ref, "error", resolveErr)
+						return resolveErr
+					}
+				}
+				if settings.wait > 0 && !pathExists(path) {
+					logger.Info("Waiting for image", "path", path)
+					return os.ErrNotExist
+				}
+				return nil
+			})
+			if resolveErr != nil {
+				return "", fmt.Errorf("resolve %s: %w", ref, resolveErr)
+			}
+			if path != ref {
+				logger.Info("Resolved path", "ref", ref, "path", path)
+			}
+			return path, nil
+		}
+		if imagePath != "" {
+			if imagePath, err = waitPath(imagePath); err != nil {
+				return err
+			}
+		}
+		if profile != nil {
+			for i := range profile.LUNs[1:] {
+				lun := &profile.LUNs[i+1]
+				if lun.File, err = waitPath(lun.File); err != nil {
+					return fmt.Errorf("LUN %d: %w", i+1, err)
+				}
 			}
-			imagePath = args[0]
-			readWrite = !mountRO // default is read-write unless -ro specified
-			useCDROM = mountCDROM
-			forceBackend = mountForce
 		}
 
-		if useCDROM && readWrite {
-			return fmt.Errorf("cannot use -cdrom with -rw (CDROM devices are always read-only)")
+		if !validMode(modeName) {
+			return fmt.Errorf("invalid mode: %s (must be auto, ro, rw, or cdrom)", modeName)
 		}
 
-		if mountRO && mountRW {
-			return fmt.Errorf("cannot use -ro with -rw (conflicting flags)")
+		cacheLimit := int64(defaultCacheLimit)
+		if mountCache != "" {
+			var err error
+			if cacheLimit, err = parseSize(mountCache); err != nil {
+				return fmt.Errorf("invalid --cache-limit: %w", err)
+			}
 		}
 
-		logger.Info("Validating image file", "path", imagePath)
-		if err := validateImage(imagePath); err != nil {
-			return fmt.Errorf("invalid image file: %w\nHint: Ensure the file exists and is readable", err)
+		// Directories are mounted from a generated image in the cache
+		var sourcePath string
+		var conversions []string
+		isDir := mountDir != ""
+		var dirDrive *DirDrive
+		if isDir {
+			sourcePath = mountDir
+			conversions = append(conversions, "directory")
+			var err error
+			if modeName == "rw" {
+				// Writable drives get a private image that is synced back on unmount
+				free := int64(defaultDirFree)
+				if mountDirFree != "" {
+					if free, err = parseSize(mountDirFree); err != nil {
+						return fmt.Errorf("invalid --dir-free: %w", err)
+					}
+				}
+				if dirDrive, err = buildDirDrive(mountDir, free, mountDryRun); err != nil {
+					return fmt.Errorf("directory drive: %w", err)
+				}
+				imagePath = dirDrive.Image
+			} else if imagePath, err = buildDirImage(mountDir, cacheLimit, mountDryRun); err != nil {
+				return fmt.Errorf("directory drive: %w", err)
+			}
+		} else if mountDirFree != "" {
+			return fmt.Errorf("--dir-free requires --dir")
+		}
+		if isDir && mountOverlay {
+			return fmt.Errorf("cannot use --overlay with --dir")
+		}
+
+		// Composed disks are assembled from partition images with device-mapper
+		var composed *composeLayout
+		if mountCompose != "" {
+			var err error
+			if composed, err = planCompose(mountCompose); err != nil {
+				return fmt.Errorf("compose: %w", err)
+			}
+			sourcePath = composed.spec
+			conversions = append(conversions, fmt.Sprintf("composed from %d partitions", len(composed.parts)))
+			if modeName == "auto" {
+				// A partition table makes it a hard disk
+				modeName = "rw"
+			}
+		}
+		generated := isDir || composed != nil
+
+		// Numbered split sets (image.001, image.002, ...) are joined into one device
+		var splitSet []string
+		if !generated {
+			var err error
+			if splitSet, err = splitParts(imagePath); err != nil {
+				return fmt.Errorf("invalid split image: %w", err)
+			}
+		}
+
+		isBlockDev := !generated && splitSet == nil && isBlockDevice(imagePath)
+		if isBlockDev {
+			if !mountBlockDev {
+				return fmt.Errorf("%s is a block device\nHint: Use --allow-block-device to expose block devices such as SD cards", imagePath)
+			}
+			if mountVerify || mountSum != "" {
+				return fmt.Errorf("--verify is not supported for block devices")
+			}
+			logger.Info("Validating block device", "path", imagePath)
+			if err := validateBlockDevice(imagePath); err != nil {
+				return fmt.Errorf("unsafe block device: %w", err)
+			}
+		} else if splitSet != nil {
+			if mountVerify || mountSum != "" {
+				return fmt.Errorf("--verify is not supported for split images")
+			}
+			logger.Info("Validating split image", "parts", len(splitSet))
+			if _, err := validateSplit(splitSet); err != nil {
+				return fmt.Errorf("invalid split image: %w", err)
+			}
+			imagePath = splitSet[0]
+		} else if !generated {
+			logger.Info("Validating image file", "path", imagePath)
+			if err := validateImage(imagePath); err != nil {
+				return fmt.Errorf("invalid image file: %w\nHint: Ensure the file exists and is readable", err)
+			}
 		}
 
 		// Resolve to absolute path and resolve symlinks
-		var err error
-		imagePath, err = filepath.Abs(imagePath)
-		if err != nil {
-			return fmt.Errorf("resolve path: %w", err)
+		if !generated {
+			imagePath, err = filepath.Abs(imagePath)
+			if err != nil {
+				return fmt.Errorf("resolve path: %w", err)
+			}
+			imagePath, err = filepath.EvalSymlinks(imagePath)
+			if err != nil {
+				return fmt.Errorf("resolve symlinks: %w", err)
+			}
+			sourcePath = imagePath
+			if splitSet != nil {
+				if splitSet, err = splitParts(imagePath); err != nil {
+					return fmt.Errorf("invalid split image: %w", err)
+				}
+			}
 		}
-		imagePath, err = filepath.EvalSymlinks(imagePath)
-		if err != nil {
-			return fmt.Errorf("resolve symlinks: %w", err)
+
+		// Verify checksum before anything else touches the image
+		if mountVerify || mountSum != "" {
+			var checksum *Checksum
+			if mountSum != "" {
+				checksum, err = parseChecksum(mountSum)
+			} else {
+				checksum, err = findChecksum(imagePath)
+			}
+			if err != nil {
+				return fmt.Errorf("checksum: %w", err)
+			}
+			logger.Info("Verifying image checksum", "algorithm", checksum.Algorithm, "source", checksum.Source)
+			if err := verifyImage(imagePath, checksum); err != nil {
+				return fmt.Errorf("image verification failed: %w\nHint: The image may be truncated or corrupted, download it again", err)
+			}
+		}
+
+		// Compressed images are mounted from a decompressed copy in the cache
+		var comp *compression
+		if !isBlockDev && !generated && splitSet == nil {
+			if comp, err = detectCompression(imagePath); err != nil {
+				return fmt.Errorf("detect compression: %w", err)
+			}
+		}
+		if comp != nil {
+			if !mountUnpack {
+				return fmt.Errorf("image is %s compressed, the host would see garbage\nHint: Use --decompress to mount a decompressed copy from the image cache", comp.name)
+			}
+			conversions = append(conversions, comp.name+" compressed")
+			if mountDryRun {
+				fmt.Printf("Dry run: Would decompress %s image into %s\n", comp.name, cacheDir())
+			} else {
+				imagePath, err = decompressImage(imagePath, comp, cacheLimit)
+				if err != nil {
+					return fmt.Errorf("decompress image: %w", err)
+				}
+			}
+		}
+
+		// Virtual disks are mounted from a raw copy in the cache
+		var format *diskFormat
+		if !isBlockDev && !generated && splitSet == nil {
+			if format, err = detectDiskFormat(imagePath); err != nil {
+				return fmt.Errorf("detect disk format: %w", err)
+			}
+		}
+		if format != nil {
+			conversions = append(conversions, format.name+" virtual disk")
+			if mountDryRun {
+				fmt.Printf("Dry run: Would convert %s image into %s\n", format.name, cacheDir())
+			} else {
+				imagePath, err = convertToCache(imagePath, format, cacheLimit)
+				if err != nil {
+					return fmt.Errorf("convert image: %w\nHint: Convert it manually with 'usbdrive convert'", err)
+				}
+			}
+		}
+
+		// The joined device is created read-only or not, so a split set needs
+		// its mode before it is joined. The first part holds the partition
+		// table and the ISO descriptors.
+		modeReason := ""
+		if splitSet != nil && modeName == "auto" {
+			detected, reason, err := detectMode(splitSet[0], 0)
+			if err != nil {
+				return fmt.Errorf("detect mode: %w", err)
+			}
+			logger.Info("Selected mode automatically", "mode", detected, "reason", reason)
+			modeName = detected
+			modeReason = reason
+		}
+
+		// Overlays are keyed on the image the user named, not the joined device
+		overlayImage := imagePath
+		if splitSet != nil {
+			overlayImage = splitSet[0]
+			conversions = append(conversions, fmt.Sprintf("split into %d parts", len(splitSet)))
+			if mountDryRun {
+				fmt.Printf("Dry run: Would join %d parts with device-mapper\n", len(splitSet))
+			} else {
+				device, err := attachSplit(splitSet, modeName != "rw")
+				if err != nil {
+					if err := releaseDevices(); err != nil {
+						logger.Warn("Failed to release devices", "error", err)
+					}
+					return fmt.Errorf("join split image: %w", err)
+				}
+				// Don't leave the joined device behind if a later step fails
+				defer func() {
+					if !mounted {
+						if err := releaseDevices(); err != nil {
+							logger.Warn("Failed to release devices", "error", err)
+						}
+					}
+				}()
+				imagePath = device
+			}
+		}
+
+		if composed != nil {
+			if mountDryRun {
+				fmt.Printf("Dry run: Would compose the following disk with device-mapper:\n")
+				composed.printLayout()
+				imagePath = "/dev/mapper/" + composed.name()
+			} else {
+				device, err := attachCompose(composed, modeName == "ro")
+				if err != nil {
+					if err := releaseDevices(); err != nil {
+						logger.Warn("Failed to release devices", "error", err)
+					}
+					return fmt.Errorf("compose disk: %w", err)
+				}
+				defer func() {
+					if !mounted {
+						if err := releaseDevices(); err != nil {
+							logger.Warn("Failed to release devices", "error", err)
+						}
+					}
+				}()
+				imagePath = device
+			}
+		}
+
+		// Expose a partition or byte range through a loop device
+		useLoop := mountPart != 0 || mountOffset != "" || mountLimit != ""
+		var loopOffset, loopSize int64
+		if mountPart != 0 && (mountOffset != "" || mountLimit != "") {
+			return fmt.Errorf("cannot use --partition with --offset or --sizelimit (conflicting flags)")
+		}
+		if mountPart != 0 {
+			part, err := findPartition(imagePath, mountPart)
+			if err != nil {
+				return fmt.Errorf("find partition: %w", err)
+			}
+			loopOffset, loopSize = part.Offset, part.Size
+			logger.Info("Found partition", "number", part.Number, "offset", part.Offset, "size", part.Size)
+		}
+		if mountOffset != "" {
+			if loopOffset, err = parseSize(mountOffset); err != nil {
+				return fmt.Errorf("invalid --offset: %w", err)
+			}
+		}
+		if mountLimit != "" {
+			if loopSize, err = parseSize(mountLimit); err != nil {
+				return fmt.Errorf("invalid --sizelimit: %w", err)
+			}
+		}
+		if useLoop {
+			size, err := imageSetSize(imagePath)
+			if err != nil {
+				return err
+			}
+			if loopOffset%512 != 0 || loopSize%512 != 0 {
+				return fmt.Errorf("offset and size limit must be multiples of 512 bytes")
+			}
+			if loopOffset >= size || loopSize > size-loopOffset {
+				return fmt.Errorf("range (offset %d, size %d) exceeds image size %d", loopOffset, loopSize, size)
+			}
+		}
+
+		// Pick the mode from the image content
+		if modeName == "auto" {
+			detected, reason, err := detectMode(imagePath, loopOffset)
+			if err != nil {
+				return fmt.Errorf("detect mode: %w", err)
+			}
+			logger.Info("Selected mode automatically", "mode", detected, "reason", reason)
+			modeName = detected
+			modeReason = reason
 		}
 
-		backend, err := selectBackend(forceBackend)
+		// Android or a download may still hold the image
+		var sources []string
+		switch {
+		case composed != nil:
+			for _, part := range composed.parts {
+				if !part.scratch {
+					sources = append(sources, part.path)
+				}
+			}
+		case splitSet != nil:
+			sources = splitSet
+		case !isDir:
+			sources = []string{sourcePath}
+		}
+		// Overlays and cached copies never write the source
+		writable := modeName == "rw" && !mountOverlay && comp == nil && format == nil
+		if err := checkBusy(sources, writable, mountBusy); err != nil {
+			return err
+		}
+
+		// The gadget drops partial sectors and rejects tiny images
+		if !useLoop && !isBlockDev && splitSet == nil && composed == nil {
+			if err := fitImageSize(imagePath, modeName == "cdrom", mountPad, mountDryRun); err != nil {
+				return fmt.Errorf("invalid image size: %w", err)
+			}
+		}
+
+		// Further LUNs of a profile are mounted as they are
+		var extraLUNs []LUN
+		if profile != nil {
+			for i, lun := range profile.LUNs[1:] {
+				lunMode, err := prepareLUN(lun, mountPad, mountBusy, mountDryRun)
+				if err != nil {
+					return fmt.Errorf("LUN %d: %w", i+1, err)
+				}
+				extraLUNs = append(extraLUNs, LUN{
+					File:          lun.File,
+					MountOptions:  MountOptions{ReadWrite: lunMode == "rw", CDROM: lunMode == "cdrom"},
+					LUNAttributes: lun.LUNAttributes,
+				})
+			}
+		}
+
+		// Writes go to a delta file instead of the image
+		var overlay *Overlay
+		var overlaySize int64
+		if mountOverlay {
+			if profile != nil {
+				return fmt.Errorf("cannot use --overlay with a config profile")
+			}
+			if !mountDryRun {
+				if err := releaseDevices(); err != nil {
+					logger.Warn("Failed to release stale devices", "error", err)
+				}
+			}
+			state, err := loadState()
+			if err != nil {
+				return err
+			}
+			var resumed bool
+			overlay, resumed = findOverlay(state, overlayImage, loopOffset, loopSize)
+			if overlay.Name != "" {
+				return fmt.Errorf("the overlay of %s is already in use\nHint: Unmount it first", overlayImage)
+			}
+			if overlaySize = loopSize; overlaySize == 0 {
+				size, err := imageSetSize(imagePath)
+				if err != nil {
+					return err
+				}
+				overlaySize = size - loopOffset
+			}
+			if overlaySize%512 != 0 {
+				return fmt.Errorf("--overlay needs an image size that is a multiple of 512 bytes")
+			}
+			if resumed {
+				logger.Info("Resuming overlay", "delta", overlay.Delta)
+			}
+		}
+
+		readWrite = modeName == "rw"
+		useCDROM = modeName == "cdrom"
+
+		var backend Backend
+		if settings.wait > 0 && !mountDryRun {
+			err = retryBackoff(deadline, pollInterval, nil, func() error {
+				backend, err = selectBackend(forceBackend)
+				return err
+			})
+		} else {
+			backend, err = selectBackend(forceBackend)
+		}
 		if err != nil {
 			return err
 		}
+		if profile != nil {
+			if configfs, ok := backend.(*ConfigFSBackend); ok {
+				configfs.Gadget = profile.Gadget
+				configfs.UDC = profile.UDC
+			} else if profile.needsConfigFS() {
+				return fmt.Errorf("profile %s needs the configfs backend (multiple LUNs, gadget settings or LUN attributes), but %s was selected", profile.name, backend.Name())
+			}
+		}
+		if _, ok := backend.(*ConfigFSBackend); !ok && settings.attributes() != (LUNAttributes{}) {
+			return fmt.Errorf("LUN attributes (removable, nofua, inquiry) need the configfs backend, but %s was selected", backend.Name())
+		}
 
 		mode := getMode(readWrite, useCDROM)
 
 		if mountDryRun {
-			fileInfo, _ := os.Stat(imagePath)
+			size, sizeErr := imageSetSize(imagePath)
 			fmt.Printf("Dry run: Would mount with the following settings:\n")
 			fmt.Printf("  Backend: %s\n", backend.Name())
 			fmt.Printf("  File: %s\n", imagePath)
-			if fileInfo != nil {
-				fmt.Printf("  Size: %d bytes (%.2f MB)\n", fileInfo.Size(), float64(fileInfo.Size())/1024/1024)
+			if len(conversions) > 0 {
+				fmt.Printf("  Source: %s (%s)\n", sourcePath, strings.Join(conversions, ", "))
+			}
+			if sizeErr == nil {
+				fmt.Printf("  Size: %d bytes (%.2f MB)\n", size, float64(size)/1024/1024)
+			}
+			if isBlockDev {
+				fmt.Printf("  Device: %s\n", blockDeviceIdentity(imagePath))
+			}
+			if useLoop {
+				fmt.Printf("  Loop device: offset %d, size limit %d (0 = to end of file)\n", loopOffset, loopSize)
+			}
+			if overlay != nil {
+				if fileExists(overlay.Delta) {
+					fmt.Printf("  Overlay: %s (resumed, %s)\n", overlay.Delta, overlayUsage(overlay))
+				} else {
+					fmt.Printf("  Overlay: %s (new)\n", overlay.Delta)
+				}
+			}
+			if modeReason != "" {
+				fmt.Printf("  Mode: %s (auto: %s)\n", mode, modeReason)
+			} else {
+				fmt.Printf("  Mode: %s\n", mode)
+			}
+			if attrs := settings.attributes(); attrs != (LUNAttributes{}) {
+				fmt.Printf("  Attributes: removable %v, nofua %v, inquiry %q\n", boolAttr(attrs.Removable, true), boolAttr(attrs.NoFUA, false), attrs.Inquiry)
+			}
+			for i, lun := range extraLUNs {
+				fmt.Printf("  LUN %d: %s (%s)\n", i+1, lun.File, getMode(lun.ReadWrite, lun.CDROM))
+			}
+			if profile != nil {
+				fmt.Printf("  Profile: %s\n", profile.name)
+				if profile.UDC != "" {
+					fmt.Printf("  UDC: %s\n", profile.UDC)
+				}
+				if profile.Gadget != nil {
+					for _, field := range gadgetFields {
+						if value := *field.value(profile.Gadget); value != "" {
+							fmt.Printf("  Gadget %s: %s\n", field.key, value)
+						}
+					}
+				}
 			}
-			fmt.Printf("  Mode: %s\n", mode)
 			
 			// Show backend capabilities
 			if backend.Name() == "configfs" {
@@ -208,11 +758,426 @@ var mountCmd = &cobra.Command{
 			CDROM:     useCDROM,
 		}
 
-		if err := backend.Mount(imagePath, opts); err != nil {
+		var hooks Hooks
+		hookEnv := map[string]string{"USBDRIVE_FILE": sourcePath, "USBDRIVE_BACKEND": backend.Name()}
+		if profile != nil {
+			if profile.Hooks != nil {
+				hooks = *profile.Hooks
+			}
+			hookEnv["USBDRIVE_PROFILE"] = profile.name
+		}
+		if err := runHook("pre_mount", hooks.PreMount, hookEnv); err != nil {
+			return err
+		}
+
+		if dirDrive != nil {
+			if err := recordDirDrive(dirDrive); err != nil {
+				return fmt.Errorf("record directory drive: %w", err)
+			}
+		}
+
+		mountPath := imagePath
+		if useLoop || (overlay != nil && !isBlockDev && splitSet == nil) {
+			// The origin of an overlay is never written
+			loop, err := attachLoop(imagePath, loopOffset, loopSize, !readWrite || overlay != nil)
+			if err != nil {
+				return fmt.Errorf("attach loop device: %w", err)
+			}
+			if err := recordLoop(loop); err != nil {
+				logger.Warn("Failed to record loop device in state", "error", err)
+			}
+			mountPath = loop.Device
+		}
+
+		if overlay != nil {
+			device, err := attachOverlay(overlay, mountPath, overlaySize)
+			if err != nil {
+				if err := releaseDevices(); err != nil {
+					logger.Warn("Failed to release devices", "error", err)
+				}
+				return fmt.Errorf("attach overlay: %w", err)
+			}
+			mountPath = device
+		}
+
+		luns := append([]LUN{{File: mountPath, MountOptions: opts, LUNAttributes: settings.attributes()}}, extraLUNs...)
+		if configfs, ok := backend.(*ConfigFSBackend); ok {
+			err = configfs.MountLUNs(luns)
+		} else {
+			err = backend.Mount(mountPath, opts)
+		}
+		if err != nil {
+			if err := releaseDevices(); err != nil {
+				logger.Warn("Failed to release devices", "error", err)
+			}
+			if err := releaseDirDrives(); err != nil {
+				logger.Warn("Failed to release directory drives", "error", err)
+			}
 			return fmt.Errorf("mount failed: %w\nHint: Try running with -v for verbose output", err)
 		}
 
+		// Release loop and snapshot devices of a previously mounted image
+		if err := releaseDevices(); err != nil {
+			logger.Warn("Failed to release devices", "error", err)
+		}
+		if err := releaseDirDrives(); err != nil {
+			return fmt.Errorf("image mounted, but the previous directory drive failed to sync: %w", err)
+		}
+
+		mounted = true
+		if err := recordUnmountHook(hooks.PostUnmount); err != nil {
+			logger.Warn("Failed to record unmount hook", "error", err)
+		}
+
+		// Remember the mount for boot, or forget the one it replaced
+		if mountPersist {
+			last, err := newLastMount(cmd, settings)
+			if err == nil {
+				err = saveLastMount(last)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: image mounted, but it will not be restored on boot: %v\n", err)
+			}
+		} else if err := clearLastMount(); err != nil {
+			logger.Warn("Failed to clear last mount", "error", err)
+		}
 		logger.Info("Successfully mounted image")
+		if err := runHook("post_mount", hooks.PostMount, hookEnv); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: image mounted, but %v\n", err)
+		}
+		return nil
+	},
+}
+
+var liveCmd = &cobra.Command{
+	Use:   "live [flags] <iso>",
+	Short: "Boot a live ISO with a persistence disk",
+	Long:  "Mount a live Linux ISO as a CDROM and an ext4 persistence image as a second drive.\nThe persistence image is created on first use and reused afterwards.\nRequires the configfs backend.",
+	Args:  cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("must run as root")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !liveDryRun {
+			unlock, err := acquireLock(lockTimeout)
+			if err != nil {
+				return err
+			}
+			defer unlock()
+		}
+
+		logger.Info("Validating image file", "path", args[0])
+		if err := validateImage(args[0]); err != nil {
+			return fmt.Errorf("invalid image file: %w\nHint: Ensure the file exists and is readable", err)
+		}
+		iso, err := filepath.Abs(args[0])
+		if err != nil {
+			return fmt.Errorf("resolve path: %w", err)
+		}
+		if iso, err = filepath.EvalSymlinks(iso); err != nil {
+			return fmt.Errorf("resolve symlinks: %w", err)
+		}
+
+		if err := fitImageSize(iso, true, livePad, liveDryRun); err != nil {
+			return fmt.Errorf("invalid image size: %w", err)
+		}
+		if err := checkBusy([]string{iso}, false, liveBusy); err != nil {
+			return err
+		}
+
+		var flavor *liveFlavor
+		if liveLabel != "" {
+			flavor = flavorForLabel(liveLabel)
+		} else if flavor, err = detectLiveFlavor(iso); err != nil {
+			return fmt.Errorf("detect live system: %w", err)
+		}
+		logger.Info("Detected live system", "flavor", flavor.name, "label", flavor.label)
+
+		persistence := livePersistFile
+		if persistence == "" {
+			persistence = persistencePath(iso, flavor)
+		}
+		var size int64
+		if livePersistence != "" {
+			if size, err = parseSize(livePersistence); err != nil {
+				return fmt.Errorf("invalid --persistence: %w", err)
+			}
+		}
+		create := !fileExists(persistence)
+		if create && size == 0 {
+			return fmt.Errorf("no persistence image at %s\nHint: Use --persistence 4G to create one", persistence)
+		}
+		if !create && size != 0 {
+			logger.Info("Reusing existing persistence image, --persistence size ignored", "path", persistence)
+		}
+		if !create {
+			if err := checkBusy([]string{persistence}, true, liveBusy); err != nil {
+				return err
+			}
+		}
+
+		backend := &ConfigFSBackend{}
+		if liveDryRun {
+			fmt.Printf("Dry run: Would mount a live system with persistence:\n")
+			fmt.Printf("  LUN 0: %s (cdrom)\n", iso)
+			if create {
+				fmt.Printf("  LUN 1: %s (new, %s ext4 labelled %s)\n", persistence, formatSize(size), flavor.label)
+			} else {
+				fmt.Printf("  LUN 1: %s (existing)\n", persistence)
+			}
+			if flavor.param != "" {
+				fmt.Printf("  Kernel parameter: %s\n", flavor.param)
+			}
+			if !backend.Supported() {
+				fmt.Printf("  WARNING: configfs backend not available\n")
+			}
+			return nil
+		}
+		if !backend.Supported() {
+			return fmt.Errorf("configfs backend not available\nHint: Live persistence needs two LUNs, which only configfs supports")
+		}
+
+		if create {
+			if err := createPersistence(persistence, size, flavor); err != nil {
+				return fmt.Errorf("create persistence image: %w", err)
+			}
+			logger.Info("Created persistence image", "path", persistence, "size", size)
+		}
+
+		luns := []LUN{
+			{File: iso, MountOptions: MountOptions{CDROM: true}},
+			{File: persistence, MountOptions: MountOptions{ReadWrite: true}},
+		}
+		if err := backend.MountLUNs(luns); err != nil {
+			return fmt.Errorf("mount failed: %w\nHint: Try running with -v for verbose output", err)
+		}
+
+		// Release devices and directory drives of a previously mounted image
+		if err := releaseDevices(); err != nil {
+			logger.Warn("Failed to release devices", "error", err)
+		}
+		if err := releaseDirDrives(); err != nil {
+			return fmt.Errorf("image mounted, but the previous directory drive failed to sync: %w", err)
+		}
+		if err := recordUnmountHook(""); err != nil {
+			logger.Warn("Failed to clear unmount hook", "error", err)
+		}
+		if err := clearLastMount(); err != nil {
+			logger.Warn("Failed to clear last mount", "error", err)
+		}
+
+		if flavor.param != "" {
+			fmt.Printf("Add '%s' to the kernel command line to enable persistence\n", flavor.param)
+		}
+		logger.Info("Successfully mounted live system")
+		return nil
+	},
+}
+
+var splitCmd = &cobra.Command{
+	Use:   "split [flags] <image> [output-dir]",
+	Short: "Split an image for FAT32 media",
+	Long:  "Split an image into numbered parts (image.001, image.002, ...) that fit on FAT32.\nMount the first part to use the parts as one drive.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		outDir := filepath.Dir(args[0])
+		if len(args) == 2 {
+			outDir = args[1]
+		}
+
+		size := int64(defaultSplitSize)
+		if splitSize != "" {
+			var err error
+			if size, err = parseSize(splitSize); err != nil {
+				return fmt.Errorf("invalid --size: %w", err)
+			}
+		}
+
+		parts, err := splitImage(args[0], outDir, size)
+		if err != nil {
+			return fmt.Errorf("split failed: %w", err)
+		}
+		for _, part := range parts {
+			fmt.Println(part)
+		}
+		return nil
+	},
+}
+
+var composeCmd = &cobra.Command{
+	Use:   "compose <spec>",
+	Short: "Show the layout of a composed disk",
+	Long:  "Validate a compose spec and show the partition layout 'mount --compose' would expose.\nThe spec is JSON listing partition images, e.g.\n  {\"table\": \"gpt\", \"partitions\": [{\"file\": \"efi.img\", \"type\": \"efi\"}, {\"size\": \"1G\"}]}",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		layout, err := planCompose(args[0])
+		if err != nil {
+			return fmt.Errorf("compose: %w", err)
+		}
+		layout.printLayout()
+		return nil
+	},
+}
+
+var multibootCmd = &cobra.Command{
+	Use:   "multiboot",
+	Short: "Build multi-ISO boot images",
+	Long:  "Build disk images that boot any of several ISOs from a GRUB menu.",
+}
+
+var multibootBuildCmd = &cobra.Command{
+	Use:   "build [flags] <catalog> <output>",
+	Short: "Build a multiboot image from a catalog of ISOs",
+	Long:  "Build a GPT disk image with a GRUB EFI system partition and a FAT32 partition holding the ISOs.\nThe catalog is a JSON file listing the ISOs, or a directory of .iso files.\nMount the output read-write like any other disk image.",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var free int64
+		if multibootFree != "" {
+			var err error
+			if free, err = parseSize(multibootFree); err != nil {
+				return fmt.Errorf("invalid --free: %w", err)
+			}
+		}
+		if err := buildMultiboot(args[0], args[1], multibootGrub, free, multibootDryRun); err != nil {
+			return fmt.Errorf("multiboot build failed: %w", err)
+		}
+		return nil
+	},
+}
+
+var overlayCmd = &cobra.Command{
+	Use:   "overlay",
+	Short: "Manage copy-on-write overlays",
+	Long:  "Manage the deltas of images mounted with --overlay.\nDeltas are kept across mounts until they are committed or discarded.",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Cobra only runs the nearest persistent hook, so set up logging here too
+		rootCmd.PersistentPreRun(cmd, args)
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("must run as root")
+		}
+		return nil
+	},
+}
+
+var overlayListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List overlay deltas",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state, err := loadState()
+		if err != nil {
+			return err
+		}
+		if len(state.Overlays) == 0 {
+			fmt.Println("No overlays")
+			return nil
+		}
+		for i := range state.Overlays {
+			overlay := &state.Overlays[i]
+			fmt.Printf("%s\n", overlay.Image)
+			if overlay.Offset != 0 || overlay.SizeLimit != 0 {
+				fmt.Printf("  Range: offset %d, size limit %d\n", overlay.Offset, overlay.SizeLimit)
+			}
+			fmt.Printf("  Delta: %s\n", overlay.Delta)
+			fmt.Printf("  Usage: %s\n", overlayUsage(overlay))
+			if overlay.Name != "" {
+				fmt.Printf("  Active: %s\n", overlay.Device)
+			}
+		}
+		return nil
+	},
+}
+
+var overlayCommitCmd = &cobra.Command{
+	Use:   "commit <image>",
+	Short: "Write an overlay's changes into the image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		unlock, err := acquireLock(lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		overlays, err := inactiveOverlays(args[0])
+		if err != nil {
+			return err
+		}
+		for i := range overlays {
+			overlay := &overlays[i]
+			if strings.HasPrefix(overlay.Image, cacheDir()+"/") {
+				return fmt.Errorf("overlay is over a cached copy (%s), its changes cannot be committed to the original\nHint: Use 'usbdrive overlay discard' instead", overlay.Image)
+			}
+			logger.Info("Committing overlay", "delta", overlay.Delta, "image", overlay.Image)
+			if err := commitDelta(overlay); err != nil {
+				return fmt.Errorf("commit overlay: %w\nHint: The delta is kept, the commit can be retried", err)
+			}
+			if err := removeOverlay(overlay); err != nil {
+				return err
+			}
+			fmt.Printf("Committed overlay into %s\n", overlay.Image)
+		}
+		return nil
+	},
+}
+
+var overlayDiscardCmd = &cobra.Command{
+	Use:   "discard <image>",
+	Short: "Delete an overlay, keeping the image as it was",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		unlock, err := acquireLock(lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		overlays, err := inactiveOverlays(args[0])
+		if err != nil {
+			return err
+		}
+		for i := range overlays {
+			if err := removeOverlay(&overlays[i]); err != nil {
+				return err
+			}
+			fmt.Printf("Discarded overlay of %s\n", overlays[i].Image)
+		}
+		return nil
+	},
+}
+
+var convertCmd = &cobra.Command{
+	Use:   "convert [flags] <input> [output]",
+	Short: "Convert a virtual disk to a raw image",
+	Long:  "Convert a qcow2, VHD, VHDX, VMDK or DMG virtual disk to a sparse raw image.\nThe output defaults to the input path with an .img extension.",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		input := args[0]
+
+		format, err := detectDiskFormat(input)
+		if err != nil {
+			return fmt.Errorf("detect disk format: %w", err)
+		}
+		if format == nil {
+			return fmt.Errorf("unsupported virtual disk format: %s\nHint: Supported formats are qcow2, VHD, VHDX, VMDK and DMG", input)
+		}
+
+		output := filepath.Join(filepath.Dir(input), rawImageName(input, format))
+		if len(args) > 1 {
+			output = args[1]
+		}
+		if pathExists(output) {
+			return fmt.Errorf("output already exists: %s", output)
+		}
+
+		if err := convertFile(input, output, format); err != nil {
+			return err
+		}
+
+		fmt.Printf("Converted %s image to %s\n", format.name, output)
 		return nil
 	},
 }
@@ -249,13 +1214,118 @@ var umountCmd = &cobra.Command{
 			return nil
 		}
 
+		unlock, err := acquireLock(lockTimeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
 		logger.Info("Preparing to unmount", "backend", backend.Name())
 
 		if err := backend.Unmount(); err != nil {
 			return fmt.Errorf("unmount failed: %w\nHint: Try running with -v for verbose output", err)
 		}
 
+		if err := releaseDevices(); err != nil {
+			logger.Warn("Failed to release devices", "error", err)
+		}
+
+		// Copy changes made on the host back into mounted directories
+		if err := releaseDirDrives(); err != nil {
+			return err
+		}
+
 		logger.Info("Successfully unmounted image")
+		if err := clearLastMount(); err != nil {
+			logger.Warn("Failed to clear last mount", "error", err)
+		}
+		if state, err := loadState(); err == nil && state.UnmountHook != "" {
+			hook := state.UnmountHook
+			if err := recordUnmountHook(""); err != nil {
+				logger.Warn("Failed to clear unmount hook", "error", err)
+			}
+			if err := runHook("post_unmount", hook, map[string]string{"USBDRIVE_BACKEND": backend.Name()}); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: image unmounted, but %v\n", err)
+			}
+		}
+		return nil
+	},
+}
+
+var bootCmd = &cobra.Command{
+	Use:   "boot",
+	Short: "Mount the configured profile on boot",
+	Long: "Mount the configured profile once Android has booted, for the module's service script.\n" +
+		"Waits for sys.boot_completed and for the USB gadget to be ready, mounts configfs if needed, and retries\n" +
+		"while the gadget is busy. Without a config file, mounts the last image mounted with --persist.\n" +
+		"Logs to logcat with tag usbdrive.",
+	Args: cobra.NoArgs,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("must run as root")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger = bootLogger()
+		deadline := time.Now().Add(bootTimeout)
+
+		path := configPath(bootConfig)
+		var last *LastMount
+		if !fileExists(path) {
+			var err error
+			if last, err = loadLastMount(); err != nil {
+				logger.Error("Failed to read last mount", "error", err)
+				return err
+			}
+			if last == nil {
+				logger.Info("No config file or persisted mount, nothing to mount", "path", path)
+				return nil
+			}
+		}
+
+		if err := waitBootCompleted(deadline); err != nil {
+			logger.Warn("Boot did not complete in time, mounting anyway", "timeout", bootTimeout, "error", err)
+		}
+		if err := ensureConfigFS(); err != nil {
+			logger.Warn("Failed to mount configfs", "error", err)
+		}
+		if err := waitGadget(deadline); err != nil {
+			logger.Warn("USB gadget not ready in time, mounting anyway", "timeout", bootTimeout, "error", err)
+		}
+
+		// Mount as 'usbdrive mount -c <config> [-p <profile>]' would, or
+		// as the persisted mount was made
+		var mountArgs []string
+		if last != nil {
+			var err error
+			if mountArgs, err = last.apply(mountCmd); err == nil {
+				err = mountCmd.Flags().Set("persist", "true")
+			}
+			if err != nil {
+				logger.Error("Failed to restore last mount", "error", err)
+				return err
+			}
+			logger.Info("Restoring last mount", "command", last.String())
+		} else {
+			if err := mountCmd.Flags().Set("config", path); err != nil {
+				return err
+			}
+			if bootProfile != "" {
+				if err := mountCmd.Flags().Set("profile", bootProfile); err != nil {
+					return err
+				}
+			}
+			logger.Info("Mounting from config", "path", path, "profile", bootProfile)
+		}
+		err := mountWithRetry(deadline, func() error {
+			return mountCmd.RunE(mountCmd, mountArgs)
+		})
+		if err != nil {
+			logger.Error("Boot mount failed", "error", err)
+			return err
+		}
+		logger.Info("Boot mount succeeded")
 		return nil
 	},
 }
@@ -263,8 +1333,10 @@ var umountCmd = &cobra.Command{
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show current mount status",
-	Long:  "Show current mount status including backend, file, and mount mode.",
-	Args:  cobra.NoArgs,
+	Long: "Show current mount status including backend, file, and mount mode.\n" +
+		"With --save-profile, save what is mounted as a profile of the config file: the images with their\n" +
+		"mode and LUN attributes, the backend, and on configfs the UDC and USB descriptors.",
+	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		backends := []Backend{&ConfigFSBackend{}, &UDCBackend{}, &SysfsBackend{}}
 
@@ -283,18 +1355,254 @@ var statusCmd = &cobra.Command{
 			if status.Mounted {
 				fmt.Printf("Status: Mounted\n")
 				fmt.Printf("File: %s\n", status.File)
+				if overlay := activeOverlay(status.File); overlay != nil {
+					fmt.Printf("Overlay: %s over %s\n", overlay.Delta, overlay.Image)
+					fmt.Printf("Overlay usage: %s\n", overlayUsage(overlay))
+				} else if mapping := findMapping(status.File); mapping != nil && mapping.Compose != "" {
+					fmt.Printf("Composed disk: %s (%d partitions)\n", mapping.Compose, len(mapping.Parts))
+				} else if mapping != nil && len(mapping.Parts) > 0 {
+					fmt.Printf("Split image: %s (%d parts)\n", mapping.Parts[0], len(mapping.Parts))
+				} else if backing := loopBacking(status.File); backing != "" {
+					loopDir := filepath.Join("/sys/block", filepath.Base(status.File), "loop")
+					offset, _ := readFile(filepath.Join(loopDir, "offset"))
+					sizeLimit, _ := readFile(filepath.Join(loopDir, "sizelimit"))
+					fmt.Printf("Backing file: %s (offset %s, size limit %s)\n", backing, offset, sizeLimit)
+				} else if isBlockDevice(status.File) {
+					fmt.Printf("Device: %s\n", blockDeviceIdentity(status.File))
+				}
 				fmt.Printf("Mode: %s\n", getMode(!status.ReadOnly, status.CDROM))
+				if last, err := loadLastMount(); err == nil && last != nil && !fileExists(configPath(statusConfig)) {
+					fmt.Printf("Restored on boot: %s\n", last)
+				}
+				for i, lun := range status.LUNs {
+					if lun.Mounted {
+						fmt.Printf("LUN %d: %s (%s)\n", i+1, lun.File, getMode(!lun.ReadOnly, lun.CDROM))
+					}
+				}
 			} else {
 				fmt.Printf("Status: Not mounted\n")
 			}
+
+			if statusSaveProfile != "" {
+				if !status.Mounted {
+					return fmt.Errorf("nothing is mounted, there is no state to save")
+				}
+				path := configPath(statusConfig)
+				profile, err := liveProfile(backend, status)
+				if err != nil {
+					return fmt.Errorf("cannot save profile: %w", err)
+				}
+				if err := saveProfile(path, statusSaveProfile, profile); err != nil {
+					return fmt.Errorf("failed to save profile: %w", err)
+				}
+				fmt.Printf("Saved profile %s to %s\n", statusSaveProfile, path)
+			}
 			return nil
 		}
 
+		if statusSaveProfile != "" {
+			return fmt.Errorf("no active USB gadget found, there is no state to save")
+		}
 		fmt.Println("No active USB gadget found")
 		return nil
 	},
 }
 
+var profilesCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "List the profiles of a configuration file",
+	Long:  "List the profiles of a configuration file and check that each can be mounted.\nThe default profile, mounted by 'mount -c' without -p, is marked with *.",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(profilesConfig)
+		if err != nil {
+			return fmt.Errorf("failed to load config: read config file: %w", err)
+		}
+		file, problems := parseConfig(data)
+		if file == nil {
+			return fmt.Errorf("failed to load config: %w", &configError{File: profilesConfig, Problems: problems})
+		}
+
+		names := file.names()
+		width := 0
+		for _, name := range names {
+			width = max(width, len(name))
+		}
+		defaultName := file.defaultName()
+		invalid := 0
+		for _, name := range names {
+			profile := file.Profiles[name]
+			marker := " "
+			if name == defaultName {
+				marker = "*"
+			}
+			var errs []string
+			for _, problem := range problems {
+				if file.owner(problem) == name {
+					errs = append(errs, problem.String())
+				}
+			}
+			for i, lun := range profile.LUNs {
+				if i == 0 {
+					fmt.Printf("%s %-*s  %s (%s)\n", marker, width, name, lun.File, lun.mode())
+				} else {
+					fmt.Printf("  %-*s  %s (%s)\n", width, "", lun.File, lun.mode())
+				}
+				if lun.File != "" {
+					if path, err := resolvePath(lun.File); err != nil {
+						message, _, _ := strings.Cut(err.Error(), "\n")
+						errs = append(errs, message)
+					} else if err := validateImage(path); err != nil {
+						errs = append(errs, err.Error())
+					}
+				}
+			}
+			if len(profile.LUNs) == 0 {
+				fmt.Printf("%s %-*s  (no LUNs)\n", marker, width, name)
+			}
+			for _, err := range errs {
+				fmt.Printf("  %-*s  Invalid: %s\n", width, "", err)
+			}
+			if len(errs) > 0 {
+				invalid++
+			}
+		}
+
+		// Problems outside the profiles make the whole file unusable
+		var fileProblems []configProblem
+		for _, problem := range problems {
+			if file.owner(problem) == "" {
+				fileProblems = append(fileProblems, problem)
+			}
+		}
+		if len(fileProblems) > 0 {
+			return fmt.Errorf("failed to load config: %w", &configError{File: profilesConfig, Problems: fileProblems})
+		}
+		if invalid > 0 {
+			return fmt.Errorf("%d of %d profiles are invalid", invalid, len(names))
+		}
+		return nil
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect configuration files",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show [flags] [file]",
+	Short: "Show a configuration file or the effective mount settings",
+	Long: "Show a configuration file in the current format.\n" +
+		"With --resolved, show the settings 'usbdrive mount' would use with the same flags and file and where\n" +
+		"each comes from: built-in defaults, then the config file or the sidecar of the image, then USBDRIVE_*\n" +
+		"environment variables, then flags.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 0 && !configResolved {
+			return fmt.Errorf("a file argument needs --resolved")
+		}
+		if configResolved {
+			settings, err := resolveMountSettings(cmd, args)
+			if err != nil {
+				return err
+			}
+			settings.print()
+			return nil
+		}
+
+		path := configPath(mountConfig)
+		file, err := readConfigFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		data, err := json.MarshalIndent(file, "", "  ")
+		if err != nil {
+			return err
+		}
+		if file.migrated {
+			fmt.Fprintf(os.Stderr, "Note: %s uses the version 1 format, shown migrated to version %d\n", path, configVersion)
+		}
+		fmt.Println(string(data))
+		return nil
+	},
+}
+
+var sidecarCmd = &cobra.Command{
+	Use:   "sidecar",
+	Short: "Manage the settings files kept next to images",
+	Long: "A sidecar is a settings file next to an image, named after it with " + sidecarSuffix + "\n" +
+		"appended, e.g. win11.iso" + sidecarSuffix + ". 'usbdrive mount <file>' applies it on top of the defaults,\n" +
+		"below environment variables and flags.",
+}
+
+var sidecarWriteCmd = &cobra.Command{
+	Use:   "write <file>",
+	Short: "Save mount flags as the sidecar of an image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkModeFlags(); err != nil {
+			return err
+		}
+		image, err := resolvePath(args[0])
+		if err != nil {
+			return err
+		}
+		if !fileExists(image) {
+			return fmt.Errorf("image not found: %s", image)
+		}
+
+		sidecar := &Sidecar{Backend: mountForce, LUNAttributes: LUNAttributes{Inquiry: mountInquiry}}
+		sidecar.Mode, _ = flagMode()
+		if cmd.Flags().Changed("removable") {
+			sidecar.Removable = &mountRemovable
+		}
+		if cmd.Flags().Changed("nofua") {
+			sidecar.NoFUA = &mountNoFUA
+		}
+		if *sidecar == (Sidecar{}) {
+			return fmt.Errorf("no settings to save\nHint: Give the mount flags to save, e.g. --cdrom --inquiry \"Linux   File-CD Gadget   0404\"")
+		}
+		r := &configReader{}
+		r.checkSidecar(sidecar)
+		if len(r.problems) > 0 {
+			return &configError{File: sidecarPath(image), Problems: r.problems}
+		}
+
+		if err := writeSidecar(image, sidecar); err != nil {
+			return err
+		}
+		fmt.Printf("Saved sidecar: %s\n", sidecarPath(image))
+		return nil
+	},
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check [file]",
+	Short: "Check a configuration file",
+	Long: "Check a configuration file (default " + defaultConfigPath + ") and list every problem:\n" +
+		"invalid settings, missing or unreadable images, backends this device lacks, modes the backend\n" +
+		"cannot mount and conflicting LUNs.",
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var file string
+		if len(args) > 0 {
+			file = args[0]
+		}
+		path := configPath(file)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read config file: %w", err)
+		}
+
+		if problems := checkConfig(data); len(problems) > 0 {
+			return &configError{File: path, Problems: problems}
+		}
+		fmt.Printf("%s: OK\n", path)
+		return nil
+	},
+}
+
 func main() {
 	// Disable auto-generated commands
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
@@ -303,18 +1611,113 @@ func main() {
 	// Mount flags
 	mountCmd.Flags().SortFlags = false
 	mountCmd.Flags().StringVarP(&mountConfig, "config", "c", "", "load configuration from file")
+	mountCmd.Flags().StringVarP(&mountProfile, "profile", "p", "", "mount a named profile of the config (default config: "+defaultConfigPath+")")
 	
 	mountCmd.Flags().BoolVar(&mountRW, "rw", false, "mount as read-write (default)")
 	mountCmd.Flags().BoolVar(&mountRO, "ro", false, "mount as read-only")
 	mountCmd.Flags().BoolVar(&mountCDROM, "cdrom", false, "mount as CDROM device")
+	mountCmd.Flags().StringVar(&mountMode, "mode", "", "mount mode: auto, rw, ro, or cdrom")
+	mountCmd.Flags().BoolVar(&mountRemovable, "removable", true, "present the LUN as removable media (configfs)")
+	mountCmd.Flags().BoolVar(&mountNoFUA, "nofua", false, "ignore the host's force unit access flag (configfs)")
+	mountCmd.Flags().StringVar(&mountInquiry, "inquiry", "", "SCSI inquiry string: vendor (8), product (16) and revision (4) characters (configfs)")
 	
+	mountCmd.Flags().BoolVar(&mountVerify, "verify", false, "verify image checksum before mounting")
+	mountCmd.Flags().StringVar(&mountSum, "checksum", "", "expected checksum (sha256:<hex> or sha512:<hex>), implies --verify")
+
+	mountCmd.Flags().BoolVar(&mountUnpack, "decompress", false, "decompress .gz/.xz/.zst/.bz2 images into the image cache")
+	mountCmd.Flags().StringVar(&mountDir, "dir", "", "expose a directory as a FAT32 drive (read-only unless -rw)")
+	mountCmd.Flags().StringVar(&mountDirFree, "dir-free", "", "free space on a writable directory drive, e.g. 4G (default 1G)")
+	mountCmd.Flags().StringVar(&mountCompose, "compose", "", "expose partition images listed in a JSON spec as one partitioned disk")
+	mountCmd.Flags().StringVar(&mountCache, "cache-limit", "", "maximum image cache size, e.g. 8G (default 8G)")
+
+	mountCmd.Flags().IntVar(&mountPart, "partition", 0, "expose only partition N of the image through a loop device")
+	mountCmd.Flags().StringVar(&mountOffset, "offset", "", "expose the image starting at this byte offset, e.g. 1M")
+	mountCmd.Flags().StringVar(&mountLimit, "sizelimit", "", "expose at most this many bytes, e.g. 512M")
+
+	mountCmd.Flags().BoolVar(&mountOverlay, "overlay", false, "keep the image unchanged and send writes to a copy-on-write delta")
+	mountCmd.Flags().BoolVar(&mountPad, "pad", false, "sparse-extend images that are not a whole number of sectors")
+	mountCmd.Flags().BoolVar(&mountBusy, "force-busy", false, "mount read-write even if another process or loop device holds the image")
+	mountCmd.Flags().BoolVar(&mountBlockDev, "allow-block-device", false, "allow exposing unmounted, non-system block devices such as SD cards")
+
 	mountCmd.Flags().StringVarP(&mountForce, "force", "f", "", "force backend: configfs, sysfs, or udc")
+	mountCmd.Flags().BoolVar(&mountPersist, "persist", false, "mount again on boot when there is no config file, until unmounted")
+	mountCmd.Flags().StringVar(&mountWait, "wait", "", "wait up to this long for the image, its volume and the USB gadget (e.g. 60s on boot)")
+	mountCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "how long to wait for another usbdrive command to finish")
 	mountCmd.Flags().BoolVarP(&mountDryRun, "dry-run", "n", false, "preview operation without executing")
 	mountCmd.Flags().BoolVarP(&mountVerbose, "verbose", "v", false, "verbose output")
 
+	// Convert flags
+	convertCmd.Flags().BoolVarP(&convertVerbose, "verbose", "v", false, "verbose output")
+
+	// Split flags
+	splitCmd.Flags().StringVarP(&splitSize, "size", "s", "", "maximum part size, a multiple of 512 bytes (default 4095M)")
+	splitCmd.Flags().BoolVarP(&splitVerbose, "verbose", "v", false, "verbose output")
+
+	// Live flags
+	liveCmd.Flags().SortFlags = false
+	liveCmd.Flags().StringVar(&livePersistence, "persistence", "", "size of a new persistence image, e.g. 4G")
+	liveCmd.Flags().StringVar(&livePersistFile, "persistence-file", "", "persistence image to create or reuse (default in /data/adb/usbdrive/persistence)")
+	liveCmd.Flags().StringVar(&liveLabel, "label", "", "filesystem label the live system looks for (default detected from the ISO)")
+	liveCmd.Flags().BoolVar(&livePad, "pad", false, "sparse-extend an ISO that is not a whole number of sectors")
+	liveCmd.Flags().BoolVar(&liveBusy, "force-busy", false, "mount even if another process or loop device holds the persistence image")
+	liveCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "how long to wait for another usbdrive command to finish")
+	liveCmd.Flags().BoolVarP(&liveDryRun, "dry-run", "n", false, "preview operation without executing")
+	liveCmd.Flags().BoolVarP(&liveVerbose, "verbose", "v", false, "verbose output")
+
+	// Multiboot flags
+	multibootBuildCmd.Flags().SortFlags = false
+	multibootBuildCmd.Flags().StringVar(&multibootGrub, "grub", filepath.Join(stateDir, "grub"), "directory with the GRUB EFI binaries (BOOTX64.EFI, ...)")
+	multibootBuildCmd.Flags().StringVar(&multibootFree, "free", "", "free space to leave on the ISO partition, e.g. 8G")
+	multibootBuildCmd.Flags().BoolVarP(&multibootDryRun, "dry-run", "n", false, "preview operation without executing")
+	multibootBuildCmd.Flags().BoolVarP(&multibootVerbose, "verbose", "v", false, "verbose output")
+
+	// Overlay flags
+	overlayCommitCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "how long to wait for another usbdrive command to finish")
+	overlayDiscardCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "how long to wait for another usbdrive command to finish")
+
+	// Boot flags
+	bootCmd.Flags().SortFlags = false
+	bootCmd.Flags().StringVarP(&bootConfig, "config", "c", "", "configuration file (default "+defaultConfigPath+")")
+	bootCmd.Flags().StringVarP(&bootProfile, "profile", "p", "", "profile to mount instead of the default one")
+	bootCmd.Flags().DurationVar(&bootTimeout, "timeout", defaultBootTimeout, "how long to wait for boot to complete and the USB gadget to be ready")
+
+	// Status flags
+	statusCmd.Flags().StringVar(&statusSaveProfile, "save-profile", "", "save the mounted state as a profile with this name")
+	statusCmd.Flags().StringVarP(&statusConfig, "config", "c", "", "configuration file boot reads and --save-profile saves to (default "+defaultConfigPath+")")
+
+	// Profiles flags
+	profilesCmd.Flags().StringVarP(&profilesConfig, "config", "c", defaultConfigPath, "configuration file to list")
+
+	// Config flags
+	configShowCmd.Flags().SortFlags = false
+	configShowCmd.Flags().BoolVar(&configResolved, "resolved", false, "show the effective mount settings and their sources")
+	configShowCmd.Flags().StringVarP(&mountConfig, "config", "c", "", "configuration file (default "+defaultConfigPath+")")
+	configShowCmd.Flags().StringVarP(&mountProfile, "profile", "p", "", "profile to resolve")
+	configShowCmd.Flags().BoolVar(&mountRW, "rw", false, "resolve as if mounting read-write")
+	configShowCmd.Flags().BoolVar(&mountRO, "ro", false, "resolve as if mounting read-only")
+	configShowCmd.Flags().BoolVar(&mountCDROM, "cdrom", false, "resolve as if mounting as CDROM")
+	configShowCmd.Flags().StringVar(&mountMode, "mode", "", "resolve with this mount mode")
+	configShowCmd.Flags().StringVarP(&mountForce, "force", "f", "", "resolve with this backend")
+	configShowCmd.Flags().StringVar(&mountWait, "wait", "", "resolve with this wait")
+	configShowCmd.Flags().BoolVar(&mountRemovable, "removable", true, "resolve with this removable flag")
+	configShowCmd.Flags().BoolVar(&mountNoFUA, "nofua", false, "resolve with this nofua flag")
+	configShowCmd.Flags().StringVar(&mountInquiry, "inquiry", "", "resolve with this inquiry string")
+
+	// Sidecar flags
+	sidecarWriteCmd.Flags().SortFlags = false
+	sidecarWriteCmd.Flags().BoolVar(&mountRW, "rw", false, "mount read-write")
+	sidecarWriteCmd.Flags().BoolVar(&mountRO, "ro", false, "mount read-only")
+	sidecarWriteCmd.Flags().BoolVar(&mountCDROM, "cdrom", false, "mount as CDROM device")
+	sidecarWriteCmd.Flags().StringVar(&mountMode, "mode", "", "mount mode: auto, rw, ro, or cdrom")
+	sidecarWriteCmd.Flags().StringVarP(&mountForce, "force", "f", "", "backend: configfs, sysfs, or udc")
+	sidecarWriteCmd.Flags().BoolVar(&mountRemovable, "removable", true, "present the LUN as removable media (configfs)")
+	sidecarWriteCmd.Flags().BoolVar(&mountNoFUA, "nofua", false, "ignore the host's force unit access flag (configfs)")
+	sidecarWriteCmd.Flags().StringVar(&mountInquiry, "inquiry", "", "SCSI inquiry string: vendor (8), product (16) and revision (4) characters (configfs)")
+
 	// Unmount flags
 	umountCmd.Flags().SortFlags = false
 	umountCmd.Flags().StringVarP(&unmountForce, "force", "f", "", "force backend: configfs, sysfs, or udc")
+	umountCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", defaultLockTimeout, "how long to wait for another usbdrive command to finish")
 	umountCmd.Flags().BoolVarP(&unmountDryRun, "dry-run", "n", false, "preview operation without executing")
 	umountCmd.Flags().BoolVarP(&unmountVerbose, "verbose", "v", false, "verbose output")
 
@@ -323,6 +1726,23 @@ func main() {
 	rootCmd.AddCommand(mountCmd)
 	rootCmd.AddCommand(umountCmd)
 	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(bootCmd)
+	rootCmd.AddCommand(profilesCmd)
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configCheckCmd)
+	rootCmd.AddCommand(configCmd)
+	sidecarCmd.AddCommand(sidecarWriteCmd)
+	rootCmd.AddCommand(sidecarCmd)
+	rootCmd.AddCommand(liveCmd)
+	rootCmd.AddCommand(convertCmd)
+	rootCmd.AddCommand(splitCmd)
+	rootCmd.AddCommand(composeCmd)
+	multibootCmd.AddCommand(multibootBuildCmd)
+	rootCmd.AddCommand(multibootCmd)
+	overlayCmd.AddCommand(overlayListCmd)
+	overlayCmd.AddCommand(overlayCommitCmd)
+	overlayCmd.AddCommand(overlayDiscardCmd)
+	rootCmd.AddCommand(overlayCmd)
 	rootCmd.AddCommand(versionCmd)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -363,3 +1783,11 @@ func getMode(rw, cdrom bool) string {
 	}
 	return "read-only"
 }
+
+func validMode(mode string) bool {
+	switch mode {
+	case "auto", "rw", "ro", "cdrom":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	multibootESPFree     = 1 << 20
+	multibootDefaultWait = 10
+)
+
+// MultibootCatalog lists the ISOs of a multiboot image and how to boot them
+type MultibootCatalog struct {
+	Timeout int              `json:"timeout,omitempty"` // seconds, default 10
+	Images  []MultibootImage `json:"images"`
+}
+
+// MultibootImage is one menu entry. Without a kernel the ISO's own
+// /boot/grub/loopback.cfg is used, which most Linux live ISOs ship.
+type MultibootImage struct {
+	File   string `json:"file"`
+	Title  string `json:"title,omitempty"`
+	Kernel string `json:"kernel,omitempty"` // path inside the ISO, e.g. /casper/vmlinuz
+	Initrd string `json:"initrd,omitempty"`
+	Args   string `json:"args,omitempty"` // kernel arguments, $isofile is the ISO path
+}
+
+// loadCatalog reads a catalog file, or lists the ISOs in a directory.
+// Relative paths are resolved against the catalog's directory.
+func loadCatalog(path string) (*MultibootCatalog, error) {
+	catalog := &MultibootCatalog{}
+	if dirExists(path) {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && strings.EqualFold(filepath.Ext(entry.Name()), ".iso") {
+				catalog.Images = append(catalog.Images, MultibootImage{File: filepath.Join(path, entry.Name())})
+			}
+		}
+	} else {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read catalog: %w", err)
+		}
+		if err := json.Unmarshal(data, catalog); err != nil {
+			return nil, fmt.Errorf("parse catalog: %w", err)
+		}
+		for i := range catalog.Images {
+			if file := catalog.Images[i].File; file != "" && !filepath.IsAbs(file) {
+				catalog.Images[i].File = filepath.Join(filepath.Dir(path), file)
+			}
+		}
+	}
+
+	if len(catalog.Images) == 0 {
+		return nil, fmt.Errorf("catalog has no images")
+	}
+	if catalog.Timeout == 0 {
+		catalog.Timeout = multibootDefaultWait
+	}
+	seen := map[string]bool{}
+	for i, image := range catalog.Images {
+		if image.File == "" {
+			return nil, fmt.Errorf("image %d has no file", i+1)
+		}
+		name := strings.ToLower(filepath.Base(image.File))
+		if seen[name] {
+			return nil, fmt.Errorf("two images are named %s", filepath.Base(image.File))
+		}
+		seen[name] = true
+		if image.Title == "" {
+			catalog.Images[i].Title = strings.TrimSuffix(filepath.Base(image.File), filepath.Ext(image.File))
+		}
+		if image.Initrd != "" && image.Kernel == "" {
+			return nil, fmt.Errorf("image %s has an initrd but no kernel", filepath.Base(image.File))
+		}
+	}
+	return catalog, nil
+}
+
+// grubQuote quotes a string for grub.cfg
+func grubQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// grubConfig generates a menu that loopback-boots each ISO from the data
+// partition, found by its FAT volume serial
+func grubConfig(catalog *MultibootCatalog, serial uint32) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by usbdrive multiboot build\n")
+	fmt.Fprintf(&b, "set timeout=%d\nset default=0\n", catalog.Timeout)
+	for _, module := range []string{"part_gpt", "fat", "iso9660", "loopback", "search_fs_uuid", "linux"} {
+		fmt.Fprintf(&b, "insmod %s\n", module)
+	}
+	fmt.Fprintf(&b, "search --no-floppy --fs-uuid --set=isopart %04x-%04x\n", serial>>16, serial&0xffff)
+
+	for _, image := range catalog.Images {
+		fmt.Fprintf(&b, "\nmenuentry %s {\n", grubQuote(image.Title))
+		fmt.Fprintf(&b, "\tset isofile=%s\n", grubQuote("/"+filepath.Base(image.File)))
+		fmt.Fprintf(&b, "\tloopback loop \"($isopart)$isofile\"\n")
+		if image.Kernel == "" {
+			fmt.Fprintf(&b, "\tset root=(loop)\n")
+			fmt.Fprintf(&b, "\tset iso_path=\"$isofile\"\n")
+			fmt.Fprintf(&b, "\texport iso_path\n")
+			fmt.Fprintf(&b, "\tconfigfile /boot/grub/loopback.cfg\n")
+		} else {
+			fmt.Fprintf(&b, "\tlinux (loop)%s %s\n", image.Kernel, image.Args)
+			if image.Initrd != "" {
+				fmt.Fprintf(&b, "\tinitrd (loop)%s\n", image.Initrd)
+			}
+		}
+		fmt.Fprintf(&b, "}\n")
+	}
+
+	fmt.Fprintf(&b, "\nmenuentry 'Reboot' {\n\treboot\n}\n")
+	fmt.Fprintf(&b, "\nmenuentry 'Firmware setup' {\n\tfwsetup\n}\n")
+	return b.String()
+}
+
+// fatFileNode places a host file in a generated FAT tree
+func fatFileNode(name, source string) (*fatNode, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file: %s", source)
+	}
+	if info.Size() > fatMaxFileSize {
+		return nil, fmt.Errorf("%s is larger than 4 GiB, which FAT32 cannot store", source)
+	}
+	return &fatNode{
+		name:    name,
+		source:  source,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		accTime: accessTime(info),
+	}, nil
+}
+
+// fatDirNode creates an empty directory in a generated FAT tree
+func fatDirNode(name string, children ...*fatNode) *fatNode {
+	now := time.Now()
+	return &fatNode{name: name, source: name, dir: true, modTime: now, accTime: now, children: children}
+}
+
+// grubBootFiles finds the GRUB EFI binaries to install in EFI/BOOT, plus
+// any module directories such as x86_64-efi for /boot/grub
+func grubBootFiles(grubDir string) ([]*fatNode, []*fatNode, error) {
+	entries, err := os.ReadDir(grubDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read GRUB directory: %w\nHint: Put a standalone GRUB EFI binary (BOOTX64.EFI) in %s or use --grub", err, grubDir)
+	}
+
+	var efi, modules []*fatNode
+	var loaders []string
+	for _, entry := range entries {
+		path := filepath.Join(grubDir, entry.Name())
+		switch {
+		case entry.Type().IsRegular() && strings.EqualFold(filepath.Ext(entry.Name()), ".efi"):
+			node, err := fatFileNode(strings.ToUpper(entry.Name()), path)
+			if err != nil {
+				return nil, nil, err
+			}
+			efi = append(efi, node)
+			if strings.HasPrefix(strings.ToUpper(entry.Name()), "BOOT") {
+				loaders = append(loaders, entry.Name())
+			}
+		case entry.IsDir() && strings.HasSuffix(entry.Name(), "-efi"):
+			node, _, err := scanFATTree(path)
+			if err != nil {
+				return nil, nil, err
+			}
+			node.name = entry.Name()
+			modules = append(modules, node)
+		}
+	}
+	if len(loaders) == 0 {
+		return nil, nil, fmt.Errorf("no GRUB EFI binary (e.g. BOOTX64.EFI) in %s\nHint: See Multiboot Images in the README for building one with grub-mkstandalone", grubDir)
+	}
+	logger.Info("Found GRUB", "loaders", strings.Join(loaders, ", "), "module dirs", len(modules))
+	return efi, modules, nil
+}
+
+// buildMultiboot writes a GPT disk image with a GRUB EFI system partition
+// and a FAT32 data partition holding the ISOs of the catalog
+func buildMultiboot(catalogPath, output, grubDir string, free int64, dryRun bool) error {
+	catalog, err := loadCatalog(catalogPath)
+	if err != nil {
+		return err
+	}
+	output, err = filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	if pathExists(output) {
+		return fmt.Errorf("output already exists: %s", output)
+	}
+
+	// Stable serials and GUIDs for the same output path
+	sum := sha256.Sum256([]byte("multiboot|" + output))
+	dataSerial := binary.LittleEndian.Uint32(sum[0:])
+	espSerial := binary.LittleEndian.Uint32(sum[4:])
+
+	// Data partition with every ISO at its root
+	data := fatDirNode("")
+	for _, image := range catalog.Images {
+		if err := validateImage(image.File); err != nil {
+			return fmt.Errorf("invalid image %s: %w", image.File, err)
+		}
+		node, err := fatFileNode(filepath.Base(image.File), image.File)
+		if err != nil {
+			return err
+		}
+		data.children = append(data.children, node)
+	}
+	sort.Slice(data.children, func(i, j int) bool { return data.children[i].name < data.children[j].name })
+	dataVol, err := planFAT(data, "ISOS", free, dataSerial, 0)
+	if err != nil {
+		return fmt.Errorf("plan data partition: %w", err)
+	}
+
+	// EFI system partition with GRUB and the generated menu
+	efi, modules, err := grubBootFiles(grubDir)
+	if err != nil {
+		return err
+	}
+	config, err := os.CreateTemp(filepath.Dir(output), ".grub-*.cfg")
+	if err != nil {
+		return fmt.Errorf("write GRUB config: %w", err)
+	}
+	defer os.Remove(config.Name())
+	_, err = config.WriteString(grubConfig(catalog, dataSerial))
+	if closeErr := config.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write GRUB config: %w", err)
+	}
+	efiCfg, err := fatFileNode("grub.cfg", config.Name())
+	if err != nil {
+		return err
+	}
+	bootCfg := *efiCfg
+	efi = append(efi, efiCfg)
+	// GRUB looks next to its binary or in /boot/grub depending on how it was built
+	esp := fatDirNode("",
+		fatDirNode("EFI", fatDirNode("BOOT", efi...)),
+		fatDirNode("boot", fatDirNode("grub", append(modules, &bootCfg)...)),
+	)
+	espVol, err := planFAT(esp, "MULTIBOOT", multibootESPFree, espSerial, fatSectorSize)
+	if err != nil {
+		return fmt.Errorf("plan EFI system partition: %w", err)
+	}
+
+	layout := &composeLayout{
+		spec: catalogPath,
+		key:  fmt.Sprintf("%x", sum[8:16]),
+		gpt:  true,
+		parts: []composedPart{
+			{path: grubDir, name: "EFI system", typeID: mustGUID(partitionTypes["efi"].guid), sectors: int64(espVol.totalSectors)},
+			{path: catalogPath, name: "ISOs", typeID: mustGUID(partitionTypes["data"].guid), sectors: int64(dataVol.totalSectors)},
+		},
+	}
+	if err := layout.place(); err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: Would build multiboot image %s with %d images:\n", output, len(catalog.Images))
+		for _, image := range catalog.Images {
+			fmt.Printf("  %s (%s)\n", image.Title, image.File)
+		}
+		layout.printLayout()
+		return nil
+	}
+
+	out, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = writeMultiboot(out, layout, espVol, dataVol)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	logger.Info("Built multiboot image", "path", output, "images", len(catalog.Images), "size", layout.sectors*512)
+	return nil
+}
+
+// writeMultiboot writes the partition table and both volumes
+func writeMultiboot(out *os.File, layout *composeLayout, espVol, dataVol *fatVolume) error {
+	espVol.offset = layout.parts[0].start * 512
+	if err := espVol.write(out); err != nil {
+		return fmt.Errorf("write EFI system partition: %w", err)
+	}
+	dataVol.offset = layout.parts[1].start * 512
+	if err := dataVol.write(out); err != nil {
+		return fmt.Errorf("write data partition: %w", err)
+	}
+
+	if err := out.Truncate(layout.sectors * 512); err != nil {
+		return err
+	}
+	head, tail := layout.headers()
+	if _, err := out.WriteAt(head, 0); err != nil {
+		return fmt.Errorf("write partition table: %w", err)
+	}
+	if _, err := out.WriteAt(tail, layout.sectors*512-int64(len(tail))); err != nil {
+		return fmt.Errorf("write backup partition table: %w", err)
+	}
+	return out.Sync()
+}
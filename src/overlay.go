@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	cowMagic        = 0x70416e53 // "SnAp"
+	cowChunkSectors = 8          // 4 KiB chunks
+	cowChunkSize    = cowChunkSectors * 512
+	cowExceptionLen = 16
+)
+
+// Overlay is a copy-on-write delta over an image or a byte range of it.
+// While mounted, the image is the read-only origin of a device-mapper
+// snapshot and all writes land in Delta. Deltas are kept across mounts
+// until they are discarded or committed.
+type Overlay struct {
+	Image     string `json:"image"`
+	Offset    int64  `json:"offset,omitempty"`
+	SizeLimit int64  `json:"sizelimit,omitempty"`
+	Delta     string `json:"delta"`
+	Name      string `json:"name,omitempty"`   // device-mapper name while active
+	Device    string `json:"device,omitempty"` // device-mapper node while active
+}
+
+// Matches reports whether the overlay covers the given image range
+func (o *Overlay) Matches(image string, offset, sizeLimit int64) bool {
+	return o.Image == image && o.Offset == offset && o.SizeLimit == sizeLimit
+}
+
+// overlayDeltaPath returns where the delta of an image range is stored
+func overlayDeltaPath(image string, offset, sizeLimit int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", image, offset, sizeLimit)))
+	return filepath.Join(stateDir, "overlays", hex.EncodeToString(sum[:8])+"-"+filepath.Base(image)+".cow")
+}
+
+// findOverlay returns the recorded overlay for an image range, or a new
+// one with its delta path filled in
+func findOverlay(state *State, image string, offset, sizeLimit int64) (*Overlay, bool) {
+	for i := range state.Overlays {
+		if state.Overlays[i].Matches(image, offset, sizeLimit) {
+			return &state.Overlays[i], true
+		}
+	}
+	return &Overlay{Image: image, Offset: offset, SizeLimit: sizeLimit, Delta: overlayDeltaPath(image, offset, sizeLimit)}, false
+}
+
+// activeOverlay returns the overlay whose snapshot device is device
+func activeOverlay(device string) *Overlay {
+	state, err := loadState()
+	if err != nil {
+		return nil
+	}
+	for i := range state.Overlays {
+		if state.Overlays[i].Name != "" && state.Overlays[i].Device == device {
+			return &state.Overlays[i]
+		}
+	}
+	return nil
+}
+
+// inactiveOverlays returns the overlays of an image, which must not be
+// mounted
+func inactiveOverlays(image string) ([]Overlay, error) {
+	path, err := filepath.Abs(image)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	if err := releaseDevices(); err != nil {
+		logger.Warn("Failed to release devices", "error", err)
+	}
+	state, err := loadState()
+	if err != nil {
+		return nil, err
+	}
+
+	var overlays []Overlay
+	for _, overlay := range state.Overlays {
+		if overlay.Image != path {
+			continue
+		}
+		if overlay.Name != "" {
+			return nil, fmt.Errorf("overlay of %s is mounted\nHint: Run 'usbdrive umount' first", path)
+		}
+		overlays = append(overlays, overlay)
+	}
+	if len(overlays) == 0 {
+		return nil, fmt.Errorf("no overlay for %s", path)
+	}
+	return overlays, nil
+}
+
+// removeOverlay deletes an overlay's delta and forgets it
+func removeOverlay(overlay *Overlay) error {
+	if err := os.Remove(overlay.Delta); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove delta: %w", err)
+	}
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	var kept []Overlay
+	for _, o := range state.Overlays {
+		if o.Delta != overlay.Delta {
+			kept = append(kept, o)
+		}
+	}
+	state.Overlays = kept
+	return state.save()
+}
+
+// attachOverlay builds a snapshot device over origin, which is size bytes
+// long, with writes going to the overlay's delta. The origin and delta
+// loop devices are recorded in the state.
+func attachOverlay(overlay *Overlay, origin string, size int64) (string, error) {
+	if !dmSupported() {
+		return "", fmt.Errorf("device-mapper not available\nHint: --overlay needs a kernel with device-mapper snapshot support")
+	}
+
+	if !fileExists(overlay.Delta) {
+		if err := os.MkdirAll(filepath.Dir(overlay.Delta), 0700); err != nil {
+			return "", fmt.Errorf("create overlay dir: %w", err)
+		}
+		file, err := os.OpenFile(overlay.Delta, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", fmt.Errorf("create delta: %w", err)
+		}
+		// Sparse, and large enough that every chunk of the origin fits
+		err = file.Truncate(cowDeltaSize(size))
+		file.Close()
+		if err != nil {
+			os.Remove(overlay.Delta)
+			return "", fmt.Errorf("create delta: %w", err)
+		}
+		logger.Info("Created overlay delta", "path", overlay.Delta)
+	} else {
+		logger.Info("Resuming overlay delta", "path", overlay.Delta)
+	}
+
+	cow, err := attachLoop(overlay.Delta, 0, 0, false)
+	if err != nil {
+		return "", fmt.Errorf("attach delta: %w", err)
+	}
+	if err := recordLoop(cow); err != nil {
+		logger.Warn("Failed to record loop device in state", "error", err)
+	}
+
+	name := "usbdrive-" + strings.TrimSuffix(filepath.Base(overlay.Delta), ".cow")
+	if len(name) > 127 {
+		name = name[:127]
+	}
+	table := []dmTarget{{
+		Length: size / 512,
+		Type:   "snapshot",
+		Params: fmt.Sprintf("%s %s P %d", origin, cow.Device, cowChunkSectors),
+	}}
+	device, err := dmCreate(name, table, false)
+	if err != nil {
+		return "", fmt.Errorf("create snapshot: %w", err)
+	}
+
+	overlay.Name = name
+	overlay.Device = device
+	if err := recordOverlay(overlay); err != nil {
+		dmRemove(name)
+		return "", err
+	}
+	return device, nil
+}
+
+// recordOverlay adds or updates an overlay in the state
+func recordOverlay(overlay *Overlay) error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	for i := range state.Overlays {
+		if state.Overlays[i].Delta == overlay.Delta {
+			state.Overlays[i] = *overlay
+			return state.save()
+		}
+	}
+	state.Overlays = append(state.Overlays, *overlay)
+	return state.save()
+}
+
+// releaseOverlays removes snapshot devices that are no longer attached to
+// a LUN. Their deltas are kept for the next mount.
+func releaseOverlays() error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+
+	mounted := map[string]bool{}
+	for _, file := range mountedFiles() {
+		mounted[file] = true
+	}
+
+	var errs []string
+	changed := false
+	for i := range state.Overlays {
+		overlay := &state.Overlays[i]
+		if overlay.Name == "" || mounted[overlay.Device] {
+			continue
+		}
+		if err := dmRemove(overlay.Name); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		overlay.Name = ""
+		overlay.Device = ""
+		changed = true
+	}
+
+	if changed {
+		if err := state.save(); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("remove snapshot devices: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// overlayUsage describes how much of an overlay is in use, preferring the
+// live snapshot status over the delta's metadata
+func overlayUsage(overlay *Overlay) string {
+	if overlay.Name != "" {
+		if lines, err := dmStatus(overlay.Name); err == nil && len(lines) == 1 {
+			// "<allocated>/<total> <metadata>" in sectors
+			fields := strings.Fields(lines[0])
+			if len(fields) >= 1 {
+				if used, total, ok := strings.Cut(fields[0], "/"); ok {
+					usedSectors, err1 := strconv.ParseInt(used, 10, 64)
+					totalSectors, err2 := strconv.ParseInt(total, 10, 64)
+					if err1 == nil && err2 == nil && totalSectors > 0 {
+						return fmt.Sprintf("%s written (%.1f%% of delta)", formatSize(usedSectors*512), float64(usedSectors)*100/float64(totalSectors))
+					}
+				}
+				return lines[0]
+			}
+		}
+	}
+
+	delta, err := readDelta(overlay.Delta)
+	if err != nil {
+		return "unknown (" + err.Error() + ")"
+	}
+	return formatSize(int64(len(delta.exceptions))*delta.chunkSize) + " written"
+}
+
+// cowDeltaSize returns the size of a persistent snapshot store that can
+// hold every chunk of an origin of size bytes
+func cowDeltaSize(size int64) int64 {
+	chunks := (size + cowChunkSize - 1) / cowChunkSize
+	perArea := int64(cowChunkSize / cowExceptionLen)
+	areas := (chunks + perArea - 1) / perArea
+	return (2 + areas + chunks) * cowChunkSize
+}
+
+// cowException maps an origin chunk to the delta chunk holding its data
+type cowException struct {
+	old, new uint64
+}
+
+// cowDelta is a parsed persistent snapshot store, as written by the
+// kernel's dm-snapshot persistent exception store
+type cowDelta struct {
+	file       *os.File
+	chunkSize  int64
+	exceptions []cowException
+}
+
+// readDelta parses the header and exception tables of a delta file. A
+// delta the kernel never initialized has no exceptions.
+func readDelta(path string) (*cowDelta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 16)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read delta header: %w", err)
+	}
+	le := binary.LittleEndian
+	delta := &cowDelta{file: file, chunkSize: cowChunkSize}
+	if le.Uint32(header[0:]) == 0 {
+		return delta, nil
+	}
+	if le.Uint32(header[0:]) != cowMagic {
+		file.Close()
+		return nil, fmt.Errorf("not a snapshot delta: %s", path)
+	}
+	if le.Uint32(header[4:]) == 0 {
+		file.Close()
+		return nil, fmt.Errorf("delta was invalidated (it overflowed or failed)")
+	}
+	delta.chunkSize = int64(le.Uint32(header[12:])) * 512
+	if delta.chunkSize == 0 {
+		file.Close()
+		return nil, fmt.Errorf("invalid delta chunk size")
+	}
+
+	perArea := delta.chunkSize / cowExceptionLen
+	area := make([]byte, delta.chunkSize)
+	for index := int64(0); ; index++ {
+		if _, err := file.ReadAt(area, (1+index*(perArea+1))*delta.chunkSize); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read delta exceptions: %w", err)
+		}
+		for i := int64(0); i < perArea; i++ {
+			e := cowException{le.Uint64(area[i*cowExceptionLen:]), le.Uint64(area[i*cowExceptionLen+8:])}
+			// A zero new chunk marks the end of the table
+			if e.new == 0 {
+				return delta, nil
+			}
+			delta.exceptions = append(delta.exceptions, e)
+		}
+	}
+}
+
+func (d *cowDelta) Close() error {
+	return d.file.Close()
+}
+
+// commitDelta writes every chunk of an overlay's delta into its image
+func commitDelta(overlay *Overlay) error {
+	delta, err := readDelta(overlay.Delta)
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+
+	image, closeImage, err := openImageFile(overlay.Image, os.O_WRONLY)
+	if err != nil {
+		return fmt.Errorf("open image: %w", err)
+	}
+
+	limit := overlay.SizeLimit
+	if limit == 0 {
+		size, err := imageSetSize(overlay.Image)
+		if err != nil {
+			closeImage()
+			return err
+		}
+		limit = size - overlay.Offset
+	}
+
+	progress := newProgress("Committing overlay", int64(len(delta.exceptions))*delta.chunkSize)
+	defer progress.Done()
+
+	chunk := make([]byte, delta.chunkSize)
+	for _, e := range delta.exceptions {
+		if _, err := delta.file.ReadAt(chunk, int64(e.new)*delta.chunkSize); err != nil {
+			closeImage()
+			return fmt.Errorf("read delta chunk %d: %w", e.new, err)
+		}
+		progress.Write(chunk)
+
+		// The last chunk may extend past the end of the origin
+		start := int64(e.old) * delta.chunkSize
+		data := chunk
+		if start >= limit {
+			continue
+		}
+		if start+int64(len(data)) > limit {
+			data = data[:limit-start]
+		}
+		if _, err := image.WriteAt(data, overlay.Offset+start); err != nil {
+			closeImage()
+			return fmt.Errorf("write image: %w", err)
+		}
+	}
+	return closeImage()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// lastMountFile records the last mount made with --persist
+const lastMountFile = "lastmount.json"
+
+// LastMount is a mount made with --persist. Boot mounts it again when there
+// is no config file, until it is unmounted.
+type LastMount struct {
+	File  string            `json:"file,omitempty"`
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// persistedFlags are mount flags recorded as given. Mode, backend, wait,
+// LUN attributes and the config are recorded as resolved instead.
+var persistedFlags = []string{
+	"verify", "checksum", "decompress", "dir", "dir-free", "compose", "cache-limit",
+	"partition", "offset", "sizelimit", "overlay", "pad", "force-busy", "allow-block-device",
+}
+
+// newLastMount records a mount by its resolved settings. Settings from a
+// config profile are left to the profile, so later edits to it apply.
+func newLastMount(cmd *cobra.Command, settings *mountSettings) (*LastMount, error) {
+	m := &LastMount{Flags: map[string]string{}}
+	for _, name := range persistedFlags {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || !flag.Changed {
+			continue
+		}
+		value := flag.Value.String()
+		if name == "dir" || name == "compose" {
+			path, err := filepath.Abs(value)
+			if err != nil {
+				return nil, fmt.Errorf("resolve --%s: %w", name, err)
+			}
+			value = path
+		}
+		m.Flags[name] = value
+	}
+
+	if settings.profile != nil {
+		config, err := filepath.Abs(settings.Config.Value)
+		if err != nil {
+			return nil, fmt.Errorf("resolve config path: %w", err)
+		}
+		m.Flags["config"] = config
+		m.Flags["profile"] = settings.profile.name
+	} else if settings.File.Value != "" {
+		m.File = settings.File.Value
+		if !isPathRef(m.File) {
+			path, err := filepath.Abs(m.File)
+			if err != nil {
+				return nil, fmt.Errorf("resolve path: %w", err)
+			}
+			m.File = path
+		}
+	}
+
+	for _, resolved := range []struct {
+		flag string
+		setting
+	}{
+		{"mode", settings.Mode},
+		{"force", settings.Backend},
+		{"wait", settings.Wait},
+		{"removable", settings.Removable},
+		{"nofua", settings.NoFUA},
+		{"inquiry", settings.Inquiry},
+	} {
+		if resolved.Value != "" && resolved.Source != "default" && !strings.HasPrefix(resolved.Source, "config ") {
+			m.Flags[resolved.flag] = resolved.Value
+		}
+	}
+	return m, nil
+}
+
+// apply sets the recorded flags on the mount command and returns its
+// arguments
+func (m *LastMount) apply(cmd *cobra.Command) ([]string, error) {
+	for name, value := range m.Flags {
+		if err := cmd.Flags().Set(name, value); err != nil {
+			return nil, fmt.Errorf("restore --%s: %w", name, err)
+		}
+	}
+	if m.File == "" {
+		return nil, nil
+	}
+	return []string{m.File}, nil
+}
+
+// String shows the recorded mount as a command line
+func (m *LastMount) String() string {
+	parts := []string{"usbdrive mount"}
+	names := make([]string, 0, len(m.Flags))
+	for name := range m.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("--%s=%q", name, m.Flags[name]))
+	}
+	if m.File != "" {
+		parts = append(parts, fmt.Sprintf("%q", m.File))
+	}
+	return strings.Join(parts, " ")
+}
+
+// loadLastMount reads the persisted mount, or returns nil if there is none
+func loadLastMount() (*LastMount, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, lastMountFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read last mount: %w", err)
+	}
+	m := &LastMount{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse last mount: %w", err)
+	}
+	return m, nil
+}
+
+// saveLastMount records a mount for boot to restore
+func saveLastMount(m *LastMount) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(lastMountFile, data)
+}
+
+// clearLastMount forgets the persisted mount
+func clearLastMount() error {
+	err := os.Remove(filepath.Join(stateDir, lastMountFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("clear last mount: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	qcow2OffsetMask       = 0x00fffffffffffe00
+	qcow2Compressed       = 1 << 62
+	qcow2ZeroCluster      = 1
+	qcow2IncompatDirty    = 1 << 0
+	qcow2IncompatCorrupt  = 1 << 1
+	qcow2IncompatExtData  = 1 << 2
+	qcow2IncompatCompress = 1 << 3
+	qcow2IncompatExtL2    = 1 << 4
+	qcow2IncompatKnown    = qcow2IncompatDirty | qcow2IncompatCorrupt | qcow2IncompatExtData | qcow2IncompatCompress | qcow2IncompatExtL2
+
+	// qcow2MaxL1Bytes is the largest L1 table QEMU itself creates
+	qcow2MaxL1Bytes = 32 << 20
+)
+
+// qcow2Image reads QEMU copy-on-write v2/v3 images
+type qcow2Image struct {
+	file        *os.File
+	size        int64
+	clusterBits uint
+	clusterSize int64
+	l2Entries   int64
+	l1          []uint64
+	zstd        bool
+
+	// Sequential reads mostly hit the same L2 table and cluster
+	l2Offset     uint64
+	l2           []uint64
+	clusterEntry uint64
+	cluster      []byte
+}
+
+func openQcow2(path string) (diskImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := parseQcow2(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func parseQcow2(file *os.File) (*qcow2Image, error) {
+	header := make([]byte, 112)
+	if _, err := io.ReadFull(io.NewSectionReader(file, 0, int64(len(header))), header); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.HasPrefix(header, qcow2Magic) {
+		return nil, fmt.Errorf("not a qcow2 image")
+	}
+
+	be := binary.BigEndian
+	version := be.Uint32(header[4:])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("unsupported qcow2 version %d", version)
+	}
+	if be.Uint64(header[8:]) != 0 {
+		return nil, fmt.Errorf("qcow2 images with a backing file are not supported\nHint: Flatten it first with 'qemu-img convert'")
+	}
+	if be.Uint32(header[32:]) != 0 {
+		return nil, fmt.Errorf("encrypted qcow2 images are not supported")
+	}
+
+	img := &qcow2Image{
+		file:        file,
+		clusterBits: uint(be.Uint32(header[20:])),
+		size:        int64(be.Uint64(header[24:])),
+	}
+	if img.clusterBits < 9 || img.clusterBits > 21 {
+		return nil, fmt.Errorf("invalid qcow2 cluster bits %d", img.clusterBits)
+	}
+	img.clusterSize = 1 << img.clusterBits
+	img.l2Entries = img.clusterSize / 8
+	if img.size < 0 {
+		return nil, fmt.Errorf("invalid qcow2 virtual size")
+	}
+
+	if version == 3 {
+		incompat := be.Uint64(header[72:])
+		if unknown := incompat &^ qcow2IncompatKnown; unknown != 0 {
+			return nil, fmt.Errorf("qcow2 image uses unknown incompatible features (%#x)", unknown)
+		}
+		if incompat&qcow2IncompatCorrupt != 0 {
+			return nil, fmt.Errorf("qcow2 image is marked corrupt")
+		}
+		if incompat&qcow2IncompatExtData != 0 {
+			return nil, fmt.Errorf("qcow2 images with an external data file are not supported")
+		}
+		if incompat&qcow2IncompatExtL2 != 0 {
+			return nil, fmt.Errorf("qcow2 images with extended L2 entries are not supported")
+		}
+		if incompat&qcow2IncompatDirty != 0 {
+			logger.Warn("qcow2 image was not closed cleanly, data may be inconsistent")
+		}
+		if incompat&qcow2IncompatCompress != 0 && be.Uint32(header[100:]) >= 105 {
+			switch header[104] {
+			case 0:
+			case 1:
+				img.zstd = true
+			default:
+				return nil, fmt.Errorf("unsupported qcow2 compression type %d", header[104])
+			}
+		}
+	}
+
+	l1Size := be.Uint32(header[36:])
+	l1Offset := int64(be.Uint64(header[40:]))
+	// The table may cover more than the virtual size, for snapshot state or
+	// after a shrink; entries past it are never read
+	if int64(l1Size)*8 > qcow2MaxL1Bytes {
+		return nil, fmt.Errorf("invalid qcow2 L1 table size %d", l1Size)
+	}
+	if err := checkTable(file, "qcow2 L1 table", l1Offset, int64(l1Size)*8); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, int64(l1Size)*8)
+	if _, err := file.ReadAt(raw, l1Offset); err != nil {
+		return nil, fmt.Errorf("read L1 table: %w", err)
+	}
+	img.l1 = make([]uint64, l1Size)
+	for i := range img.l1 {
+		img.l1[i] = be.Uint64(raw[i*8:])
+	}
+
+	return img, nil
+}
+
+func (q *qcow2Image) Size() int64 {
+	return q.size
+}
+
+func (q *qcow2Image) Close() error {
+	return q.file.Close()
+}
+
+func (q *qcow2Image) ReadAt(p []byte, off int64) (int, error) {
+	if off >= q.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := q.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		inCluster := pos & (q.clusterSize - 1)
+		chunk := p[read:]
+		if int64(len(chunk)) > q.clusterSize-inCluster {
+			chunk = chunk[:q.clusterSize-inCluster]
+		}
+		if err := q.readCluster(chunk, pos, inCluster); err != nil {
+			return read, err
+		}
+		read += len(chunk)
+	}
+	return read, eof
+}
+
+func (q *qcow2Image) readCluster(p []byte, pos, inCluster int64) error {
+	clusterIndex := pos >> q.clusterBits
+	l1Index := clusterIndex / q.l2Entries
+	if l1Index >= int64(len(q.l1)) {
+		readZeros(p)
+		return nil
+	}
+
+	l2Offset := q.l1[l1Index] & qcow2OffsetMask
+	if l2Offset == 0 {
+		readZeros(p)
+		return nil
+	}
+	if err := q.loadL2(l2Offset); err != nil {
+		return err
+	}
+
+	entry := q.l2[clusterIndex%q.l2Entries]
+	if entry&qcow2Compressed != 0 {
+		if err := q.loadCompressed(entry); err != nil {
+			return err
+		}
+		copy(p, q.cluster[inCluster:])
+		return nil
+	}
+
+	hostOffset := entry & qcow2OffsetMask
+	if hostOffset == 0 || entry&qcow2ZeroCluster != 0 {
+		readZeros(p)
+		return nil
+	}
+
+	if _, err := q.file.ReadAt(p, int64(hostOffset)+inCluster); err != nil {
+		return fmt.Errorf("read cluster at %d: %w", hostOffset, err)
+	}
+	return nil
+}
+
+func (q *qcow2Image) loadL2(offset uint64) error {
+	if q.l2 != nil && q.l2Offset == offset {
+		return nil
+	}
+	raw := make([]byte, q.clusterSize)
+	if _, err := q.file.ReadAt(raw, int64(offset)); err != nil {
+		return fmt.Errorf("read L2 table at %d: %w", offset, err)
+	}
+	if q.l2 == nil {
+		q.l2 = make([]uint64, q.l2Entries)
+	}
+	for i := range q.l2 {
+		q.l2[i] = binary.BigEndian.Uint64(raw[i*8:])
+	}
+	q.l2Offset = offset
+	return nil
+}
+
+func (q *qcow2Image) loadCompressed(entry uint64) error {
+	if q.cluster != nil && q.clusterEntry == entry {
+		return nil
+	}
+
+	// Compressed cluster descriptor: host offset in the low x bits,
+	// additional 512-byte sector count above it
+	x := 62 - (q.clusterBits - 8)
+	hostOffset := entry & (1<<x - 1)
+	sectors := (entry>>x)&(1<<(q.clusterBits-8)-1) + 1
+	length := int64(sectors)*512 - int64(hostOffset&511)
+
+	compressed := make([]byte, length)
+	n, err := q.file.ReadAt(compressed, int64(hostOffset))
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read compressed cluster at %d: %w", hostOffset, err)
+	}
+	compressed = compressed[:n]
+
+	var r io.Reader
+	if q.zstd {
+		zr, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = flate.NewReader(bytes.NewReader(compressed))
+	}
+
+	if q.cluster == nil {
+		q.cluster = make([]byte, q.clusterSize)
+	}
+	q.clusterEntry = 0
+	n, err = io.ReadFull(r, q.cluster)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("decompress cluster at %d: %w", hostOffset, err)
+	}
+	readZeros(q.cluster[n:])
+	q.clusterEntry = entry
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// liveProfile builds a profile that mounts again what a backend exposes now
+func liveProfile(backend Backend, status *MountStatus) (*Profile, error) {
+	profile := &Profile{Backend: backend.Name()}
+	luns := append([]MountStatus{*status}, status.LUNs...)
+	for i, lun := range luns {
+		if !lun.Mounted {
+			logger.Info("Skipping empty LUN", "lun", i)
+			continue
+		}
+		image, err := savedImage(lun.File)
+		if err != nil {
+			return nil, fmt.Errorf("LUN %d: %w", i, err)
+		}
+		mode := "rw"
+		switch {
+		case lun.CDROM:
+			mode = "cdrom"
+		case lun.ReadOnly:
+			mode = "ro"
+		}
+		profile.LUNs = append(profile.LUNs, LUNConfig{File: image, Mode: mode, LUNAttributes: lun.Attributes})
+	}
+	if len(profile.LUNs) > maxLUNs {
+		return nil, fmt.Errorf("%d LUNs are mounted, a profile holds at most %d", len(profile.LUNs), maxLUNs)
+	}
+
+	if configfs, ok := backend.(*ConfigFSBackend); ok {
+		gadgetRoot, err := configfs.findGadgetRoot()
+		if err != nil {
+			return nil, err
+		}
+		if profile.UDC, err = configfs.getUSBController(gadgetRoot); err != nil {
+			return nil, fmt.Errorf("read UDC: %w", err)
+		}
+		if profile.Gadget, err = readDescriptors(gadgetRoot); err != nil {
+			return nil, err
+		}
+	}
+	return profile, nil
+}
+
+// savedImage maps the file a LUN exposes back to the image a profile would
+// name, failing for setups a profile cannot describe
+func savedImage(file string) (string, error) {
+	if overlay := activeOverlay(file); overlay != nil {
+		return "", fmt.Errorf("%s is an overlay over %s, which a profile cannot describe\nHint: Commit or discard the overlay and mount the image itself", file, overlay.Image)
+	}
+	if mapping := findMapping(file); mapping != nil {
+		if mapping.Compose != "" {
+			return "", fmt.Errorf("%s is composed from %s, which a profile cannot describe", file, mapping.Compose)
+		}
+		return "", fmt.Errorf("%s is a split image, which a profile cannot describe", file)
+	}
+	if backing := loopBacking(file); backing != "" {
+		loopDir := filepath.Join("/sys/block", filepath.Base(file), "loop")
+		offset, _ := readFile(filepath.Join(loopDir, "offset"))
+		sizeLimit, _ := readFile(filepath.Join(loopDir, "sizelimit"))
+		if offset != "0" || sizeLimit != "0" {
+			return "", fmt.Errorf("%s is a byte range of %s, which a profile cannot describe", file, backing)
+		}
+		file = backing
+	}
+	if state, err := loadState(); err == nil {
+		for _, dir := range state.Dirs {
+			if dir.Image == file {
+				return "", fmt.Errorf("%s is a drive built from %s, which a profile cannot describe", file, dir.Dir)
+			}
+		}
+	}
+	if strings.HasPrefix(file, cacheDir()+"/") {
+		return "", fmt.Errorf("%s is a decompressed or converted copy in the cache\nHint: Name the original image in the profile instead", file)
+	}
+	return file, nil
+}
+
+// saveProfile adds a profile to a config file, creating the file if needed.
+// The rest of the file is kept as it is written.
+func saveProfile(path, name string, profile *Profile) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		file := &ConfigFile{Version: configVersion, Profiles: map[string]*Profile{name: profile}}
+		data, err := json.MarshalIndent(file, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := checkSavedProfile(path, data, name, 1); err != nil {
+			return err
+		}
+		return writeConfigFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	file, problems := parseConfig(data)
+	if file == nil {
+		return &configError{File: path, Problems: problems}
+	}
+	if file.migrated {
+		return fmt.Errorf("%s uses the version 1 format, which a profile cannot be added to without rewriting it\nHint: Convert it first with 'usbdrive config show -c %s > %s.new && mv %s.new %s', then save the profile again", path, path, path, path, path)
+	}
+	if _, ok := file.Profiles[name]; ok {
+		return fmt.Errorf("profile %s already exists in %s\nHint: Choose another name, or remove the profile from the file first", name, path)
+	}
+
+	updated, err := insertProfile(data, name, profile)
+	if err != nil {
+		return fmt.Errorf("add profile to %s: %w", path, err)
+	}
+	if err := checkSavedProfile(path, updated, name, len(file.Profiles)+1); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return writeConfigFile(path, updated, info.Mode().Perm())
+}
+
+// checkSavedProfile makes sure a config file about to be written reads back
+// with the new profile valid and the other profiles kept
+func checkSavedProfile(path string, data []byte, name string, profiles int) error {
+	file, problems := parseConfig(data)
+	if file == nil || file.Profiles[name] == nil || len(file.Profiles) != profiles {
+		return fmt.Errorf("add profile to %s: the edited file does not read back", path)
+	}
+	var invalid []configProblem
+	for _, problem := range problems {
+		if file.owner(problem) == name {
+			invalid = append(invalid, problem)
+		}
+	}
+	if len(invalid) > 0 {
+		return &configError{File: path, Problems: invalid}
+	}
+	return nil
+}
+
+// insertProfile adds a profile to the profiles object of a config file,
+// following the indentation of the entries already there
+func insertProfile(data []byte, name string, profile *Profile) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("expected an object at the top level")
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "profiles" {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+			return nil, fmt.Errorf("profiles is not an object")
+		}
+		open := int(decoder.InputOffset())
+		for decoder.More() {
+			if _, err := decoder.Token(); err != nil {
+				return nil, err
+			}
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return spliceProfile(data, open, int(decoder.InputOffset())-1, name, profile)
+	}
+	return nil, fmt.Errorf("no profiles object")
+}
+
+// spliceProfile writes a profile entry between the braces of the profiles
+// object at open and close
+func spliceProfile(data []byte, open, close int, name string, profile *Profile) ([]byte, error) {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return nil, err
+	}
+	inner := data[open:close]
+	end := open + len(bytes.TrimRight(inner, " \t\r\n"))
+	empty := end == open
+
+	var entry []byte
+	if !empty && !bytes.Contains(inner, []byte("\n")) {
+		// The profiles are on one line, so is the new one
+		value, err := json.Marshal(profile)
+		if err != nil {
+			return nil, err
+		}
+		comma, colon := ",", ":"
+		if bytes.Contains(inner, []byte(": ")) {
+			comma, colon = ", ", ": "
+		}
+		entry = fmt.Appendf(nil, "%s%s%s%s", comma, key, colon, value)
+	} else {
+		// Indent like the existing entries, or one step in from the line
+		// holding the object
+		lineStart := bytes.LastIndexByte(data[:open], '\n') + 1
+		base := leadingSpace(data[lineStart:])
+		indent := base + "  "
+		if !empty {
+			first := open + len(inner) - len(bytes.TrimLeft(inner, " \t\r\n"))
+			indent = leadingSpace(data[bytes.LastIndexByte(data[:first], '\n')+1:])
+		}
+		unit := "  "
+		if len(indent) > len(base) && strings.HasPrefix(indent, base) {
+			unit = indent[len(base):]
+		}
+		value, err := json.MarshalIndent(profile, indent, unit)
+		if err != nil {
+			return nil, err
+		}
+		if empty {
+			entry = fmt.Appendf(nil, "\n%s%s: %s\n%s", indent, key, value, base)
+			return bytes.Join([][]byte{data[:open], entry, data[close:]}, nil), nil
+		}
+		entry = fmt.Appendf(nil, ",\n%s%s: %s", indent, key, value)
+	}
+	return bytes.Join([][]byte{data[:end], entry, data[end:]}, nil), nil
+}
+
+// leadingSpace returns the indentation at the start of a line
+func leadingSpace(line []byte) string {
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// writeConfigFile replaces a config file without leaving it half written
+func writeConfigFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return fmt.Errorf("write config file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write config file: %w", err)
+	}
+	return nil
+}
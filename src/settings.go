@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// setting is a resolved mount option and the layer it came from
+type setting struct {
+	Value  string
+	Source string
+}
+
+// set overrides the value unless value is empty
+func (s *setting) set(value, source string) {
+	if value != "" {
+		s.Value = value
+		s.Source = source
+	}
+}
+
+// mountSettings are the options of a mount resolved in layers: built-in
+// defaults, then the config file or the sidecar of the image, then
+// USBDRIVE_* environment variables, then command line flags
+type mountSettings struct {
+	Config    setting
+	Profile   setting
+	File      setting
+	Mode      setting
+	Backend   setting
+	Wait      setting
+	Removable setting
+	NoFUA     setting
+	Inquiry   setting
+
+	profile *Profile // nil unless a config is used
+	wait    time.Duration
+}
+
+// resolveMountSettings layers the mount options. A config is read when a
+// config file or profile is named by an environment variable or flag, and
+// a sidecar when an image is named instead.
+func resolveMountSettings(cmd *cobra.Command, args []string) (*mountSettings, error) {
+	if err := checkModeFlags(); err != nil {
+		return nil, err
+	}
+
+	s := &mountSettings{
+		Config:  setting{defaultConfigPath, "default"},
+		Profile: setting{"", "default"},
+		File:    setting{"", "default"},
+		Mode:    setting{"rw", "default"},
+		Backend: setting{"", "default"},
+		Wait:    setting{"0s", "default"},
+	}
+	flags := cmd.Flags()
+
+	// Which config to read is layered too
+	s.Config.set(os.Getenv("USBDRIVE_CONFIG"), "env USBDRIVE_CONFIG")
+	s.Profile.set(os.Getenv("USBDRIVE_PROFILE"), "env USBDRIVE_PROFILE")
+	if flags.Changed("config") {
+		s.Config.set(mountConfig, "flag --config")
+	}
+	if flags.Changed("profile") {
+		s.Profile.set(mountProfile, "flag --profile")
+	}
+
+	if s.Config.Source != "default" || s.Profile.Value != "" {
+		profile, err := loadConfig(s.Config.Value, s.Profile.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %w", err)
+		}
+		s.profile = profile
+		if s.Profile.Value == "" {
+			s.Profile = setting{profile.name, "config default"}
+		}
+		// Profiles detect the mode unless they set one
+		s.Mode = setting{"auto", "default"}
+		s.File.set(profile.LUNs[0].File, profile.source("luns[0].file"))
+		s.Mode.set(profile.LUNs[0].Mode, profile.source("luns[0].mode"))
+		s.Backend.set(profile.Backend, profile.source("backend"))
+		s.Wait.set(profile.Wait, profile.source("wait"))
+		s.setAttributes(profile.LUNs[0].LUNAttributes, func(key string) string {
+			return profile.source("luns[0]." + key)
+		})
+	}
+
+	// The image is needed first to find its sidecar
+	s.File.set(os.Getenv("USBDRIVE_FILE"), "env USBDRIVE_FILE")
+	if len(args) > 0 {
+		s.File.set(args[0], "argument")
+	}
+	if s.profile == nil && s.File.Value != "" {
+		if err := s.applySidecar(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, env := range []struct {
+		setting *setting
+		name    string
+	}{
+		{&s.Mode, "USBDRIVE_MODE"},
+		{&s.Backend, "USBDRIVE_BACKEND"},
+		{&s.Wait, "USBDRIVE_WAIT"},
+	} {
+		env.setting.set(os.Getenv(env.name), "env "+env.name)
+	}
+
+	if mode, flag := flagMode(); mode != "" {
+		s.Mode.set(mode, "flag "+flag)
+	}
+	s.Backend.set(mountForce, "flag --force")
+	s.Wait.set(mountWait, "flag --wait")
+	if flags.Changed("removable") {
+		s.Removable.set(strconv.FormatBool(mountRemovable), "flag --removable")
+	}
+	if flags.Changed("nofua") {
+		s.NoFUA.set(strconv.FormatBool(mountNoFUA), "flag --nofua")
+	}
+	s.Inquiry.set(mountInquiry, "flag --inquiry")
+
+	if !validMode(s.Mode.Value) {
+		return nil, fmt.Errorf("invalid mode: %s from %s (must be auto, ro, rw, or cdrom)", s.Mode.Value, s.Mode.Source)
+	}
+	switch s.Backend.Value {
+	case "", "configfs", "sysfs", "udc":
+	default:
+		return nil, fmt.Errorf("invalid backend: %s from %s (must be configfs, sysfs, or udc)", s.Backend.Value, s.Backend.Source)
+	}
+	wait, err := time.ParseDuration(s.Wait.Value)
+	if err != nil || wait < 0 {
+		return nil, fmt.Errorf("invalid wait: %s from %s (e.g. 30s or 2m)", s.Wait.Value, s.Wait.Source)
+	}
+	s.wait = wait
+	if err := validateInquiry(s.Inquiry.Value); err != nil {
+		return nil, fmt.Errorf("invalid inquiry string from %s: %w", s.Inquiry.Source, err)
+	}
+	return s, nil
+}
+
+// checkModeFlags rejects mode flags that contradict each other
+func checkModeFlags() error {
+	if mountRO && mountRW {
+		return fmt.Errorf("cannot use -ro with -rw (conflicting flags)")
+	}
+	if mountCDROM && mountRW {
+		return fmt.Errorf("cannot use -cdrom with -rw (CDROM devices are always read-only)")
+	}
+	if mountMode != "" && (mountRO || mountRW || mountCDROM) {
+		return fmt.Errorf("cannot use --mode with -ro, -rw or -cdrom (conflicting flags)")
+	}
+	return nil
+}
+
+// flagMode returns the mode given by the mode flags and the flag that gave
+// it, or "" if none was given
+func flagMode() (mode, flag string) {
+	switch {
+	case mountMode != "":
+		return mountMode, "--mode"
+	case mountCDROM:
+		return "cdrom", "--cdrom"
+	case mountRO:
+		return "ro", "--ro"
+	case mountRW:
+		return "rw", "--rw"
+	}
+	return "", ""
+}
+
+// applySidecar layers the sidecar of the image, if it has one. A volume
+// that isn't mounted yet has no sidecar to read.
+func (s *mountSettings) applySidecar() error {
+	image, err := resolvePath(s.File.Value)
+	if err != nil {
+		logger.Info("Skipped sidecar of unresolved image", "path", s.File.Value, "error", err)
+		return nil
+	}
+	sidecar, err := readSidecar(image)
+	if err != nil {
+		return fmt.Errorf("failed to load sidecar: %w", err)
+	}
+	if sidecar == nil {
+		return nil
+	}
+	source := "sidecar " + sidecarPath(image)
+	logger.Info("Loaded sidecar", "path", sidecarPath(image))
+	s.Mode.set(sidecar.Mode, source)
+	s.Backend.set(sidecar.Backend, source)
+	s.setAttributes(sidecar.LUNAttributes, func(string) string { return source })
+	return nil
+}
+
+// setAttributes layers the LUN attributes that are set
+func (s *mountSettings) setAttributes(attrs LUNAttributes, source func(key string) string) {
+	if attrs.Removable != nil {
+		s.Removable.set(strconv.FormatBool(*attrs.Removable), source("removable"))
+	}
+	if attrs.NoFUA != nil {
+		s.NoFUA.set(strconv.FormatBool(*attrs.NoFUA), source("nofua"))
+	}
+	s.Inquiry.set(attrs.Inquiry, source("inquiry"))
+}
+
+// attributes returns the resolved attributes of the first LUN
+func (s *mountSettings) attributes() LUNAttributes {
+	attrs := LUNAttributes{Inquiry: s.Inquiry.Value}
+	if s.Removable.Value != "" {
+		removable := s.Removable.Value == "true"
+		attrs.Removable = &removable
+	}
+	if s.NoFUA.Value != "" {
+		nofua := s.NoFUA.Value == "true"
+		attrs.NoFUA = &nofua
+	}
+	return attrs
+}
+
+// print shows each setting with the layer it came from
+func (s *mountSettings) print() {
+	backend := s.Backend
+	if backend.Value == "" {
+		backend.Value = "auto"
+	}
+	type row struct {
+		name string
+		setting
+	}
+	var rows []row
+	if s.profile != nil {
+		rows = append(rows, row{"config", s.Config}, row{"profile", s.Profile})
+	}
+	rows = append(rows, row{"file", s.File}, row{"mode", s.Mode}, row{"backend", backend}, row{"wait", s.Wait})
+	for _, attr := range []row{{"removable", s.Removable}, {"nofua", s.NoFUA}, {"inquiry", s.Inquiry}} {
+		if attr.Value != "" {
+			rows = append(rows, attr)
+		}
+	}
+	for _, row := range rows {
+		value := row.Value
+		if value == "" {
+			value = "(none)"
+		} else if row.name == "file" {
+			value = describePath(value)
+		}
+		fmt.Printf("%-10s %s (%s)\n", row.name+":", value, row.Source)
+	}
+	if s.profile == nil {
+		return
+	}
+	for i, lun := range s.profile.LUNs[1:] {
+		fmt.Printf("%-10s %s, %s (%s)\n", fmt.Sprintf("lun %d:", i+1), describePath(lun.File), lun.mode(), s.profile.source(fmt.Sprintf("luns[%d]", i+1)))
+	}
+	if s.profile.UDC != "" {
+		fmt.Printf("%-10s %s (%s)\n", "udc:", s.profile.UDC, s.profile.source("udc"))
+	}
+	if s.profile.Gadget != nil {
+		for _, field := range gadgetFields {
+			if value := *field.value(s.profile.Gadget); value != "" {
+				fmt.Printf("%-10s %s = %s (%s)\n", "gadget:", field.key, value, s.profile.source("gadget."+field.key))
+			}
+		}
+	}
+}
+
+// describePath shows a path reference along with what it resolves to now
+func describePath(ref string) string {
+	if !isPathRef(ref) {
+		return ref
+	}
+	path, err := resolvePath(ref)
+	if err != nil {
+		message, _, _ := strings.Cut(err.Error(), "\n")
+		return fmt.Sprintf("%s (unresolved: %s)", ref, message)
+	}
+	return ref + " -> " + path
+}
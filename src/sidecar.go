@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// sidecarSuffix is appended to the name of an image to find its sidecar,
+// e.g. win11.iso.usbdrive.json
+const sidecarSuffix = ".usbdrive.json"
+
+// Sidecar holds mount settings that travel with an image
+type Sidecar struct {
+	Mode    string `json:"mode,omitempty"`
+	Backend string `json:"backend,omitempty"`
+	LUNAttributes
+}
+
+// sidecarPath returns where the sidecar of an image is kept
+func sidecarPath(image string) string {
+	return image + sidecarSuffix
+}
+
+// readSidecar reads the sidecar next to an image, or returns nil if the
+// image has none
+func readSidecar(image string) (*Sidecar, error) {
+	path := sidecarPath(image)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read sidecar: %w", err)
+	}
+	root, err := decodeJSON(data)
+	if err != nil {
+		return nil, &configError{File: path, Problems: []configProblem{{Message: jsonErrorLocation(data, err)}}}
+	}
+	r := &configReader{}
+	sidecar := r.sidecar(root)
+	if len(r.problems) > 0 {
+		return nil, &configError{File: path, Problems: r.problems}
+	}
+	return sidecar, nil
+}
+
+// sidecar reads the settings of a sidecar file
+func (r *configReader) sidecar(value any) *Sidecar {
+	obj := r.object(value, "", "mode", "backend", "removable", "nofua", "inquiry")
+	if obj == nil {
+		return nil
+	}
+	sidecar := &Sidecar{
+		Mode:    r.str(obj, "", "mode"),
+		Backend: r.str(obj, "", "backend"),
+		LUNAttributes: LUNAttributes{
+			Removable: r.boolean(obj, "", "removable"),
+			NoFUA:     r.boolean(obj, "", "nofua"),
+			Inquiry:   r.str(obj, "", "inquiry"),
+		},
+	}
+	r.checkSidecar(sidecar)
+	return sidecar
+}
+
+// checkSidecar validates the settings of a sidecar
+func (r *configReader) checkSidecar(sidecar *Sidecar) {
+	if sidecar.Mode != "" && !validMode(sidecar.Mode) {
+		r.fail("mode", "invalid mode %q (must be auto, ro, rw, or cdrom)", sidecar.Mode)
+	}
+	r.backend(sidecar.Backend, "backend")
+	r.inquiry(sidecar.Inquiry, "inquiry")
+	if sidecar.Backend != "" && sidecar.Backend != "configfs" && sidecar.LUNAttributes != (LUNAttributes{}) {
+		r.fail("backend", "%s does not support LUN attributes, use configfs", sidecar.Backend)
+	}
+}
+
+// writeSidecar saves the settings of an image next to it
+func writeSidecar(image string, sidecar *Sidecar) error {
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode sidecar: %w", err)
+	}
+	if err := os.WriteFile(sidecarPath(image), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("write sidecar: %w", err)
+	}
+	return nil
+}
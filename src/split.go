@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// defaultSplitSize keeps parts below FAT32's 4 GiB file size limit while
+// staying a multiple of 512 bytes
+const defaultSplitSize = 4095 << 20
+
+// splitSuffix matches the numbered extension of a split part, e.g. ".001"
+var splitSuffix = regexp.MustCompile(`^(.*)\.(\d{3})$`)
+
+// Mapping is a device-mapper device usbdrive assembled from other devices
+type Mapping struct {
+	Name    string   `json:"name"`
+	Device  string   `json:"device"`
+	Parts   []string `json:"parts,omitempty"`
+	Compose string   `json:"compose,omitempty"` // spec of a composed disk
+}
+
+// splitParts returns the parts of a numbered split set given its first
+// part (image.001) or its base name (image), or nil if path is not split
+func splitParts(path string) ([]string, error) {
+	first := path
+	if !pathExists(path) && fileExists(path+".001") {
+		first = path + ".001"
+	}
+
+	match := splitSuffix.FindStringSubmatch(first)
+	if match == nil {
+		return nil, nil
+	}
+	number, _ := strconv.Atoi(match[2])
+	if number > 1 {
+		return nil, fmt.Errorf("%s is not the first part of a split image (start with %s.001)", filepath.Base(first), filepath.Base(match[1]))
+	}
+
+	var parts []string
+	for ; number < 1000; number++ {
+		part := fmt.Sprintf("%s.%03d", match[1], number)
+		if !fileExists(part) {
+			break
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) < 2 {
+		// A lone image.001 is just a file with an odd name
+		return nil, nil
+	}
+	return parts, nil
+}
+
+// validateSplit checks every part of a split set. All parts but the last
+// must be whole sectors, or the joined device would be misaligned.
+func validateSplit(parts []string) (int64, error) {
+	var total int64
+	for i, part := range parts {
+		if err := validateImage(part); err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(part)
+		if err != nil {
+			return 0, err
+		}
+		if info.Size()%512 != 0 {
+			if i < len(parts)-1 {
+				return 0, fmt.Errorf("part %s is not a multiple of 512 bytes", filepath.Base(part))
+			}
+			logger.Warn("Last part is not a multiple of 512 bytes, ignoring the trailing bytes", "part", part)
+		}
+		total += info.Size() / 512 * 512
+	}
+	return total, nil
+}
+
+// attachSplit joins the parts of a split set into one device with a
+// device-mapper linear table over a loop device per part
+func attachSplit(parts []string, readOnly bool) (string, error) {
+	if !dmSupported() {
+		return "", fmt.Errorf("device-mapper not available\nHint: Join the parts on a filesystem without the 4 GiB limit, e.g. cat image.0* > image.img")
+	}
+
+	var table []dmTarget
+	var start int64
+	for _, part := range parts {
+		loop, err := attachLoop(part, 0, 0, readOnly)
+		if err != nil {
+			return "", fmt.Errorf("attach %s: %w", filepath.Base(part), err)
+		}
+		if err := recordLoop(loop); err != nil {
+			logger.Warn("Failed to record loop device in state", "error", err)
+		}
+		size, err := imageSize(part)
+		if err != nil {
+			return "", err
+		}
+		table = append(table, dmTarget{
+			Start:  start,
+			Length: size / 512,
+			Type:   "linear",
+			Params: loop.Device + " 0",
+		})
+		start += size / 512
+	}
+
+	sum := sha256.Sum256([]byte(parts[0]))
+	name := "usbdrive-split-" + hex.EncodeToString(sum[:8])
+	device, err := dmCreate(name, table, readOnly)
+	if err != nil {
+		return "", fmt.Errorf("join parts: %w", err)
+	}
+
+	state, err := loadState()
+	if err == nil {
+		state.Mappings = append(state.Mappings, Mapping{Name: name, Device: device, Parts: parts})
+		err = state.save()
+	}
+	if err != nil {
+		dmRemove(name)
+		return "", err
+	}
+	return device, nil
+}
+
+// findMapping returns the assembled device with the given node
+func findMapping(device string) *Mapping {
+	state, err := loadState()
+	if err != nil {
+		return nil
+	}
+	for i := range state.Mappings {
+		if state.Mappings[i].Device == device {
+			return &state.Mappings[i]
+		}
+	}
+	return nil
+}
+
+// releaseMappings removes assembled devices that are no longer in use by a
+// LUN or a snapshot
+func releaseMappings() error {
+	state, err := loadState()
+	if err != nil {
+		return err
+	}
+	if len(state.Mappings) == 0 {
+		return nil
+	}
+
+	mounted := map[string]bool{}
+	for _, file := range mountedFiles() {
+		mounted[file] = true
+	}
+
+	var kept []Mapping
+	var errs []error
+	for _, mapping := range state.Mappings {
+		if mounted[mapping.Device] {
+			kept = append(kept, mapping)
+			continue
+		}
+		if err := dmRemove(mapping.Name); err != nil {
+			errs = append(errs, err)
+			kept = append(kept, mapping)
+		}
+	}
+
+	state.Mappings = kept
+	if err := state.save(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("remove mapped devices: %v", errs)
+	}
+	return nil
+}
+
+// imageSetSize returns the size of an image, or the joined size of a
+// split set. Parts count in whole sectors, as the joined device holds them.
+func imageSetSize(path string) (int64, error) {
+	parts, err := splitParts(path)
+	if err != nil {
+		return 0, err
+	}
+	if parts == nil {
+		return imageSize(path)
+	}
+	var total int64
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size() / 512 * 512
+	}
+	return total, nil
+}
+
+// splitFile reads and writes a split set as one contiguous file
+type splitFile struct {
+	files []*os.File
+	sizes []int64
+}
+
+// openImageFile opens an image for writing, joining split sets
+func openImageFile(path string, flag int) (io.WriterAt, func() error, error) {
+	parts, err := splitParts(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parts == nil {
+		file, err := os.OpenFile(path, flag, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		closeFile := func() error {
+			if err := file.Sync(); err != nil {
+				file.Close()
+				return err
+			}
+			return file.Close()
+		}
+		return file, closeFile, nil
+	}
+
+	split := &splitFile{}
+	for _, part := range parts {
+		file, err := os.OpenFile(part, flag, 0)
+		if err != nil {
+			split.Close()
+			return nil, nil, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			split.Close()
+			return nil, nil, err
+		}
+		split.files = append(split.files, file)
+		split.sizes = append(split.sizes, info.Size())
+	}
+	return split, split.Close, nil
+}
+
+// WriteAt writes across part boundaries; it never grows the last part
+func (s *splitFile) WriteAt(b []byte, off int64) (int, error) {
+	written := 0
+	for i, file := range s.files {
+		if len(b) == 0 {
+			break
+		}
+		if off >= s.sizes[i] {
+			off -= s.sizes[i]
+			continue
+		}
+		n := int64(len(b))
+		if off+n > s.sizes[i] {
+			n = s.sizes[i] - off
+		}
+		if _, err := file.WriteAt(b[:n], off); err != nil {
+			return written, err
+		}
+		written += int(n)
+		b = b[n:]
+		off = 0
+	}
+	if len(b) > 0 {
+		return written, fmt.Errorf("write past the end of the split image")
+	}
+	return written, nil
+}
+
+func (s *splitFile) Close() error {
+	var first error
+	for _, file := range s.files {
+		if err := file.Sync(); err != nil && first == nil {
+			first = err
+		}
+		if err := file.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// splitImage cuts an image into numbered parts of at most partSize bytes
+// in outDir, keeping holes sparse, and returns the part paths
+func splitImage(path, outDir string, partSize int64) ([]string, error) {
+	if partSize <= 0 || partSize%512 != 0 {
+		return nil, fmt.Errorf("part size must be a positive multiple of 512 bytes")
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() <= partSize {
+		return nil, fmt.Errorf("image is %s, which already fits in one part", formatSize(info.Size()))
+	}
+
+	count := int((info.Size() + partSize - 1) / partSize)
+	if count > 999 {
+		return nil, fmt.Errorf("image would need %d parts (at most 999)", count)
+	}
+	var parts []string
+	for i := 1; i <= count; i++ {
+		part := filepath.Join(outDir, fmt.Sprintf("%s.%03d", filepath.Base(path), i))
+		if pathExists(part) {
+			return nil, fmt.Errorf("output already exists: %s", part)
+		}
+		parts = append(parts, part)
+	}
+
+	progress := newProgress("Splitting", info.Size())
+	defer progress.Done()
+	reader := io.TeeReader(src, progress)
+	for _, part := range parts {
+		out, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		_, err = copySparse(out, io.LimitReader(reader, partSize))
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("write %s: %w", part, err)
+		}
+		logger.Info("Wrote part", "path", part)
+	}
+	return parts, nil
+}
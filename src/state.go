@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const stateFile = "state.json"
+
+// State records resources usbdrive created for the current mount, so they
+// can be released on unmount or cleaned up after a crash.
+type State struct {
+	Loops    []LoopDevice `json:"loops,omitempty"`
+	Dirs     []DirDrive   `json:"dirs,omitempty"`
+	Overlays []Overlay    `json:"overlays,omitempty"`
+	Mappings []Mapping    `json:"mappings,omitempty"`
+
+	// Gadget descriptors replaced by a profile, restored on unmount
+	Descriptors *GadgetConfig `json:"descriptors,omitempty"`
+	// Hook of the mounted profile to run after unmounting it
+	UnmountHook string `json:"unmount_hook,omitempty"`
+}
+
+func loadState() (*State, error) {
+	state := &State{}
+	data, err := os.ReadFile(filepath.Join(stateDir, stateFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("parse state: %w", err)
+	}
+	return state, nil
+}
+
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(stateFile, data)
+}
+
+// releaseDevices tears down snapshot, mapped and loop devices that are no
+// longer attached to a LUN, in dependency order
+func releaseDevices() error {
+	if err := releaseOverlays(); err != nil {
+		return err
+	}
+	if err := releaseMappings(); err != nil {
+		return err
+	}
+	return releaseLoops()
+}
@@ -3,11 +3,17 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// stateDir holds persistent usbdrive state such as caches
+var stateDir = "/data/adb/usbdrive"
+
 func findMountPoint(fsType string) string {
 	file, err := os.Open("/proc/mounts")
 	if err != nil {
@@ -100,6 +106,77 @@ func validateImage(path string) error {
 	return nil
 }
 
+// lunMinSectors are the smallest images f_mass_storage accepts, in sectors
+const (
+	lunMinSectors   = 1
+	cdromMinSectors = 300 // the smallest CD track
+)
+
+// checkImageSize checks an image against what the gadget can expose. It
+// returns the current size and the smallest legal size at least as large:
+// the gadget ignores a trailing partial sector and rejects tiny images.
+// A truncated ISO is an error, since padding can't bring the data back.
+func checkImageSize(path string, cdrom bool) (int64, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+
+	volume, err := isoVolumeSize(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if volume > size {
+		return 0, 0, fmt.Errorf("ISO is truncated: the volume is %d bytes but the file is %d bytes\nHint: The download may be incomplete, download it again", volume, size)
+	}
+
+	sector, minimum := int64(512), int64(lunMinSectors*512)
+	if cdrom {
+		sector, minimum = isoSectorSize, cdromMinSectors*isoSectorSize
+	}
+	legal := (size + sector - 1) / sector * sector
+	if legal < minimum {
+		legal = minimum
+	}
+	return size, legal, nil
+}
+
+// fitImageSize checks an image before it is attached to a LUN and, with
+// pad, sparse-extends it to the smallest legal size
+func fitImageSize(path string, cdrom, pad, dryRun bool) error {
+	size, legal, err := checkImageSize(path, cdrom)
+	if err != nil || size == legal {
+		return err
+	}
+
+	if !pad {
+		sector := int64(512)
+		if cdrom {
+			sector = isoSectorSize
+		}
+		if size%sector != 0 {
+			return fmt.Errorf("image size %d is not a multiple of %d bytes, the host would not see the last %d bytes\nHint: Use --pad to extend it to %d bytes", size, sector, size%sector, legal)
+		}
+		return fmt.Errorf("image is %d bytes, smaller than the %d byte minimum\nHint: Use --pad to extend it", size, legal)
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: Would pad %s from %d to %d bytes\n", path, size, legal)
+		return nil
+	}
+	logger.Info("Padding image", "path", path, "from", size, "to", legal)
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(legal); err != nil {
+		file.Close()
+		return fmt.Errorf("pad image: %w", err)
+	}
+	return file.Close()
+}
+
 func validateSafePath(path string) error {
 	// Disallow system directories
 	dangerousPaths := []string{
@@ -152,3 +229,123 @@ func verifyUnmount(lunFile string) error {
 	return nil
 }
 
+// writeStateFile atomically replaces a file in the state directory
+func writeStateFile(name string, data []byte) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("create state dir: %w", err)
+	}
+	path := filepath.Join(stateDir, name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pollInterval is how often waits check whether what they wait for is ready
+const pollInterval = 500 * time.Millisecond
+
+// retryBackoff calls try until it succeeds or the deadline passes, and
+// returns its last error. The wait after each attempt starts at
+// pollInterval and doubles up to maxDelay. Errors that retry rejects are
+// returned at once; a nil retry retries every error.
+func retryBackoff(deadline time.Time, maxDelay time.Duration, retry func(error) bool, try func() error) error {
+	delay := pollInterval
+	for {
+		err := try()
+		if err == nil || retry != nil && !retry(err) {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		time.Sleep(min(delay, remaining))
+		delay = min(delay*2, maxDelay)
+	}
+}
+
+// progress reports the progress of long operations on stderr
+type progress struct {
+	label   string
+	total   int64
+	done    int64
+	percent int
+}
+
+func newProgress(label string, total int64) *progress {
+	return &progress{label: label, total: total, percent: -1}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if p.total <= 0 {
+		return len(b), nil
+	}
+	percent := int(p.done * 100 / p.total)
+	if percent != p.percent {
+		p.percent = percent
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%% (%.1f / %.1f MB)", p.label, percent,
+			float64(p.done)/1024/1024, float64(p.total)/1024/1024)
+	}
+	return len(b), nil
+}
+
+func (p *progress) Done() {
+	if p.percent >= 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// parseSize parses sizes such as "512M", "4G" or "4GiB" into bytes.
+// Suffixes are binary multiples.
+func parseSize(value string) (int64, error) {
+	s := value
+	for _, suffix := range []string{"iB", "B"} {
+		if len(s) > len(suffix) && s[len(s)-len(suffix):] == suffix {
+			s = s[:len(s)-len(suffix)]
+			break
+		}
+	}
+
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			multiplier = 1 << 10
+		case 'M', 'm':
+			multiplier = 1 << 20
+		case 'G', 'g':
+			multiplier = 1 << 30
+		case 'T', 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size too large: %s", value)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize renders a byte count with a binary unit, e.g. "1.5 GB"
+func formatSize(n int64) string {
+	units := []string{"bytes", "KB", "MB", "GB", "TB"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const verifyCacheFile = "verify.json"
+
+// Checksum is an expected image digest and where it came from.
+type Checksum struct {
+	Algorithm string // "sha256" or "sha512"
+	Digest    string // lowercase hex
+	Source    string
+}
+
+type verifyCacheEntry struct {
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"mtime"`
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+}
+
+// parseChecksum parses "sha256:<hex>", "sha512:<hex>" or a bare hex digest.
+func parseChecksum(value string) (*Checksum, error) {
+	algo, digest, found := strings.Cut(value, ":")
+	if !found {
+		digest = algo
+		algo = ""
+	}
+	digest = strings.ToLower(strings.TrimSpace(digest))
+
+	if _, err := hex.DecodeString(digest); err != nil {
+		return nil, fmt.Errorf("invalid checksum digest: %s", digest)
+	}
+
+	expectedLen := map[string]int{"sha256": sha256.Size * 2, "sha512": sha512.Size * 2}
+	if algo == "" {
+		for name, n := range expectedLen {
+			if len(digest) == n {
+				algo = name
+			}
+		}
+		if algo == "" {
+			return nil, fmt.Errorf("cannot infer checksum algorithm from digest length %d", len(digest))
+		}
+	}
+
+	n, ok := expectedLen[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s (must be sha256 or sha512)", algo)
+	}
+	if len(digest) != n {
+		return nil, fmt.Errorf("invalid %s digest length: %d", algo, len(digest))
+	}
+
+	return &Checksum{Algorithm: algo, Digest: digest, Source: "--checksum"}, nil
+}
+
+// findChecksum looks for a checksum next to the image: <file>.sha256,
+// <file>.sha512, SHA256SUMS or SHA512SUMS.
+func findChecksum(imagePath string) (*Checksum, error) {
+	dir := filepath.Dir(imagePath)
+	base := filepath.Base(imagePath)
+
+	candidates := []struct {
+		path string
+		algo string
+	}{
+		{imagePath + ".sha256", "sha256"},
+		{imagePath + ".sha512", "sha512"},
+		{filepath.Join(dir, "SHA256SUMS"), "sha256"},
+		{filepath.Join(dir, "SHA512SUMS"), "sha512"},
+	}
+
+	for _, c := range candidates {
+		if !fileExists(c.path) {
+			continue
+		}
+		digest, err := readChecksumFile(c.path, base)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", c.path, err)
+		}
+		if digest == "" {
+			logger.Info("Checksum file has no entry for image", "path", c.path, "image", base)
+			continue
+		}
+		checksum, err := parseChecksum(c.algo + ":" + digest)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", c.path, err)
+		}
+		checksum.Source = c.path
+		return checksum, nil
+	}
+
+	return nil, fmt.Errorf("no checksum file found for %s\nHint: Place %s.sha256 or SHA256SUMS next to the image, or pass --checksum", base, base)
+}
+
+// readChecksumFile returns the digest for name from a sha*sum style file.
+// A file holding a single bare digest applies to any name.
+func readChecksumFile(path, name string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var lines [][]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	for _, fields := range lines {
+		if len(fields) < 2 {
+			continue
+		}
+		// "<digest>  <name>" or "<digest> *<name>" (binary mode)
+		entry := strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+		if filepath.Base(entry) == name {
+			return fields[0], nil
+		}
+	}
+
+	if len(lines) == 1 && len(lines[0]) == 1 {
+		return lines[0][0], nil
+	}
+
+	return "", nil
+}
+
+// verifyImage hashes the image and compares it against the expected
+// checksum. Digests are cached by path, size and mtime.
+func verifyImage(imagePath string, expected *Checksum) error {
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		return err
+	}
+
+	cache := loadVerifyCache()
+	key := imagePath + "|" + expected.Algorithm
+	entry, ok := cache[key]
+	if ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+		logger.Info("Using cached checksum", "path", imagePath, "algorithm", entry.Algorithm)
+	} else {
+		digest, err := hashFile(imagePath, expected.Algorithm, info.Size())
+		if err != nil {
+			return fmt.Errorf("hash image: %w", err)
+		}
+		entry = verifyCacheEntry{
+			Size:      info.Size(),
+			ModTime:   info.ModTime().UnixNano(),
+			Algorithm: expected.Algorithm,
+			Digest:    digest,
+		}
+		cache[key] = entry
+		if err := saveVerifyCache(cache); err != nil {
+			logger.Warn("Failed to save checksum cache", "error", err)
+		}
+	}
+
+	if entry.Digest != expected.Digest {
+		return fmt.Errorf("%s mismatch: expected %s, got %s (from %s)",
+			expected.Algorithm, expected.Digest, entry.Digest, expected.Source)
+	}
+
+	logger.Info("Checksum verified", "algorithm", expected.Algorithm, "source", expected.Source)
+	return nil
+}
+
+func hashFile(path, algorithm string, size int64) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	progress := newProgress("Verifying "+algorithm, size)
+	if _, err := io.Copy(io.MultiWriter(h, progress), file); err != nil {
+		return "", err
+	}
+	progress.Done()
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func loadVerifyCache() map[string]verifyCacheEntry {
+	cache := map[string]verifyCacheEntry{}
+	data, err := os.ReadFile(filepath.Join(stateDir, verifyCacheFile))
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		logger.Warn("Ignoring corrupt checksum cache", "error", err)
+		return map[string]verifyCacheEntry{}
+	}
+	return cache
+}
+
+func saveVerifyCache(cache map[string]verifyCacheEntry) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(verifyCacheFile, data)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	vhdMagic        = []byte("conectix")
+	vhdDynamicMagic = []byte("cxsparse")
+	vhdxMagic       = []byte("vhdxfile")
+	vhdxHeaderMagic = []byte("head")
+	vhdxRegionMagic = []byte("regi")
+	vhdxMetaMagic   = []byte("metadata")
+	vhdxBATRegion   = mustGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetaRegion  = mustGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+	vhdxFileParams  = mustGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxDiskSize    = mustGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxSectorSize  = mustGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	crc32cTable     = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+	vhdUnusedBlock      = 0xffffffff
+
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+	vhdxHasParent             = 1 << 1
+)
+
+// vhdImage reads fixed and dynamic Virtual PC / Hyper-V VHD images
+type vhdImage struct {
+	file       *os.File
+	size       int64
+	dynamic    bool
+	blockSize  int64
+	bitmapSize int64
+	bat        []uint32
+}
+
+func openVHD(path string) (diskImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := parseVHD(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func parseVHD(file *os.File) (*vhdImage, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < 512 {
+		return nil, fmt.Errorf("file too small for VHD footer")
+	}
+
+	footer := make([]byte, 512)
+	if _, err := file.ReadAt(footer, info.Size()-512); err != nil {
+		return nil, fmt.Errorf("read footer: %w", err)
+	}
+	if !bytes.HasPrefix(footer, vhdMagic) {
+		return nil, fmt.Errorf("not a VHD image")
+	}
+
+	be := binary.BigEndian
+	img := &vhdImage{
+		file: file,
+		size: int64(be.Uint64(footer[48:])),
+	}
+
+	switch diskType := be.Uint32(footer[60:]); diskType {
+	case vhdTypeFixed:
+		if img.size > info.Size()-512 {
+			return nil, fmt.Errorf("fixed VHD is truncated")
+		}
+		return img, nil
+	case vhdTypeDynamic:
+		img.dynamic = true
+	case vhdTypeDifferencing:
+		return nil, fmt.Errorf("differencing VHD images are not supported\nHint: Merge it into its parent first")
+	default:
+		return nil, fmt.Errorf("unsupported VHD disk type %d", diskType)
+	}
+
+	header := make([]byte, 1024)
+	if _, err := file.ReadAt(header, int64(be.Uint64(footer[16:]))); err != nil {
+		return nil, fmt.Errorf("read dynamic header: %w", err)
+	}
+	if !bytes.HasPrefix(header, vhdDynamicMagic) {
+		return nil, fmt.Errorf("invalid VHD dynamic header")
+	}
+
+	tableOffset := int64(be.Uint64(header[16:]))
+	entries := be.Uint32(header[28:])
+	img.blockSize = int64(be.Uint32(header[32:]))
+	if img.blockSize == 0 || img.blockSize%512 != 0 {
+		return nil, fmt.Errorf("invalid VHD block size %d", img.blockSize)
+	}
+	// One bit per sector, padded to a whole sector
+	img.bitmapSize = (img.blockSize/512/8 + 511) / 512 * 512
+
+	// One entry per block of the virtual disk
+	if blocks := (img.size + img.blockSize - 1) / img.blockSize; img.size < 0 || int64(entries) > blocks {
+		return nil, fmt.Errorf("invalid VHD block table size %d", entries)
+	}
+	if err := checkTable(file, "VHD block allocation table", tableOffset, int64(entries)*4); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, int64(entries)*4)
+	if _, err := file.ReadAt(raw, tableOffset); err != nil {
+		return nil, fmt.Errorf("read block allocation table: %w", err)
+	}
+	img.bat = make([]uint32, entries)
+	for i := range img.bat {
+		img.bat[i] = be.Uint32(raw[i*4:])
+	}
+
+	return img, nil
+}
+
+func (v *vhdImage) Size() int64 {
+	return v.size
+}
+
+func (v *vhdImage) Close() error {
+	return v.file.Close()
+}
+
+func (v *vhdImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := v.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	if !v.dynamic {
+		n, err := v.file.ReadAt(p, off)
+		if err != nil {
+			return n, err
+		}
+		return n, eof
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		block := pos / v.blockSize
+		inBlock := pos % v.blockSize
+		chunk := p[read:]
+		if int64(len(chunk)) > v.blockSize-inBlock {
+			chunk = chunk[:v.blockSize-inBlock]
+		}
+
+		if block >= int64(len(v.bat)) || v.bat[block] == vhdUnusedBlock {
+			readZeros(chunk)
+		} else {
+			dataOffset := int64(v.bat[block])*512 + v.bitmapSize + inBlock
+			if _, err := v.file.ReadAt(chunk, dataOffset); err != nil {
+				return read, fmt.Errorf("read block %d: %w", block, err)
+			}
+		}
+		read += len(chunk)
+	}
+	return read, eof
+}
+
+// vhdxImage reads Hyper-V VHDX images
+type vhdxImage struct {
+	file      *os.File
+	size      int64
+	blockSize int64
+	chunk     int64 // payload blocks per sector bitmap block
+	bat       []uint64
+}
+
+func openVHDX(path string) (diskImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := parseVHDX(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func parseVHDX(file *os.File) (*vhdxImage, error) {
+	le := binary.LittleEndian
+
+	// Two copies of the header, the one with the highest valid sequence
+	// number is current
+	var current []byte
+	var currentSeq uint64
+	for _, off := range []int64{64 << 10, 128 << 10} {
+		header := make([]byte, 4<<10)
+		if _, err := file.ReadAt(header, off); err != nil {
+			continue
+		}
+		if !bytes.HasPrefix(header, vhdxHeaderMagic) || !vhdxChecksumValid(header) {
+			continue
+		}
+		if seq := le.Uint64(header[8:]); current == nil || seq > currentSeq {
+			current = header
+			currentSeq = seq
+		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("no valid VHDX header found")
+	}
+	if !isZero(current[48:64]) {
+		return nil, fmt.Errorf("VHDX image has a pending log\nHint: Attach and detach it once in Windows to replay the log")
+	}
+
+	var batOffset, metaOffset int64
+	var batLength uint32
+	found := false
+	for _, off := range []int64{192 << 10, 256 << 10} {
+		table := make([]byte, 64<<10)
+		if _, err := file.ReadAt(table, off); err != nil {
+			continue
+		}
+		if !bytes.HasPrefix(table, vhdxRegionMagic) || !vhdxChecksumValid(table) {
+			continue
+		}
+		count := le.Uint32(table[8:])
+		for i := uint32(0); i < count && 16+int(i+1)*32 <= len(table); i++ {
+			entry := table[16+i*32:]
+			switch {
+			case bytes.Equal(entry[:16], vhdxBATRegion[:]):
+				batOffset = int64(le.Uint64(entry[16:]))
+				batLength = le.Uint32(entry[24:])
+			case bytes.Equal(entry[:16], vhdxMetaRegion[:]):
+				metaOffset = int64(le.Uint64(entry[16:]))
+			}
+		}
+		found = true
+		break
+	}
+	if !found || batOffset == 0 || metaOffset == 0 {
+		return nil, fmt.Errorf("VHDX region table is missing or invalid")
+	}
+
+	meta := make([]byte, 64<<10)
+	if _, err := file.ReadAt(meta, metaOffset); err != nil {
+		return nil, fmt.Errorf("read metadata table: %w", err)
+	}
+	if !bytes.HasPrefix(meta, vhdxMetaMagic) {
+		return nil, fmt.Errorf("invalid VHDX metadata table")
+	}
+
+	readItem := func(id [16]byte, length int) ([]byte, error) {
+		count := int(le.Uint16(meta[10:]))
+		for i := 0; i < count && 32+(i+1)*32 <= len(meta); i++ {
+			entry := meta[32+i*32:]
+			if !bytes.Equal(entry[:16], id[:]) {
+				continue
+			}
+			data := make([]byte, length)
+			if _, err := file.ReadAt(data, metaOffset+int64(le.Uint32(entry[16:]))); err != nil {
+				return nil, err
+			}
+			return data, nil
+		}
+		return nil, fmt.Errorf("metadata item %x not found", id)
+	}
+
+	params, err := readItem(vhdxFileParams, 8)
+	if err != nil {
+		return nil, fmt.Errorf("read file parameters: %w", err)
+	}
+	if le.Uint32(params[4:])&vhdxHasParent != 0 {
+		return nil, fmt.Errorf("differencing VHDX images are not supported\nHint: Merge it into its parent first")
+	}
+	diskSize, err := readItem(vhdxDiskSize, 8)
+	if err != nil {
+		return nil, fmt.Errorf("read virtual disk size: %w", err)
+	}
+	sectorSize, err := readItem(vhdxSectorSize, 4)
+	if err != nil {
+		return nil, fmt.Errorf("read logical sector size: %w", err)
+	}
+
+	img := &vhdxImage{
+		file:      file,
+		size:      int64(le.Uint64(diskSize)),
+		blockSize: int64(le.Uint32(params)),
+	}
+	if img.blockSize == 0 {
+		return nil, fmt.Errorf("invalid VHDX block size")
+	}
+	img.chunk = (1 << 23) * int64(le.Uint32(sectorSize)) / img.blockSize
+	if img.chunk == 0 {
+		return nil, fmt.Errorf("invalid VHDX chunk ratio")
+	}
+
+	if err := checkTable(file, "VHDX block allocation table", batOffset, int64(batLength)); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, batLength)
+	if _, err := file.ReadAt(raw, batOffset); err != nil {
+		return nil, fmt.Errorf("read block allocation table: %w", err)
+	}
+	img.bat = make([]uint64, len(raw)/8)
+	for i := range img.bat {
+		img.bat[i] = le.Uint64(raw[i*8:])
+	}
+
+	return img, nil
+}
+
+func (v *vhdxImage) Size() int64 {
+	return v.size
+}
+
+func (v *vhdxImage) Close() error {
+	return v.file.Close()
+}
+
+func (v *vhdxImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := v.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		block := pos / v.blockSize
+		inBlock := pos % v.blockSize
+		chunk := p[read:]
+		if int64(len(chunk)) > v.blockSize-inBlock {
+			chunk = chunk[:v.blockSize-inBlock]
+		}
+
+		// Sector bitmap entries are interleaved after every chunk of
+		// payload block entries
+		index := block + block/v.chunk
+		var entry uint64
+		if index < int64(len(v.bat)) {
+			entry = v.bat[index]
+		}
+
+		switch entry & 7 {
+		case vhdxBlockFullyPresent:
+			dataOffset := int64(entry>>20)<<20 + inBlock
+			if _, err := v.file.ReadAt(chunk, dataOffset); err != nil {
+				return read, fmt.Errorf("read block %d: %w", block, err)
+			}
+		case vhdxBlockPartiallyPresent:
+			return read, fmt.Errorf("block %d is partially present in a differencing image", block)
+		default:
+			// Not present, undefined, zero or unmapped
+			readZeros(chunk)
+		}
+		read += len(chunk)
+	}
+	return read, eof
+}
+
+// vhdxChecksumValid verifies the CRC-32C at offset 4 of a VHDX structure
+func vhdxChecksumValid(data []byte) bool {
+	expected := binary.LittleEndian.Uint32(data[4:])
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	return crc32.Checksum(buf, crc32cTable) == expected
+}
+
+// mustGUID is parseGUID for the built-in constants
+func mustGUID(s string) [16]byte {
+	guid, err := parseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return guid
+}
+
+// parseGUID converts a textual GUID to its mixed-endian on-disk form
+func parseGUID(s string) ([16]byte, error) {
+	var guid [16]byte
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 || len(s) != 36 {
+		return guid, fmt.Errorf("invalid GUID: %s", s)
+	}
+	guid[0], guid[1], guid[2], guid[3] = raw[3], raw[2], raw[1], raw[0]
+	guid[4], guid[5] = raw[5], raw[4]
+	guid[6], guid[7] = raw[7], raw[6]
+	copy(guid[8:], raw[8:])
+	return guid, nil
+}
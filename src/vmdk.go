@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	vmdkMagic           = []byte("KDMV")
+	vmdkDescriptorMagic = []byte("# Disk DescriptorFile")
+)
+
+const (
+	vmdkGDAtEnd          = 0xffffffffffffffff
+	vmdkFlagCompressed   = 1 << 16
+	vmdkZeroGrain        = 1
+	vmdkMaxDescriptorLen = 1 << 20
+)
+
+// vmdkSparse reads a VMware hosted sparse extent (monolithicSparse and
+// streamOptimized)
+type vmdkSparse struct {
+	file       *os.File
+	size       int64
+	grainSize  int64
+	gtEntries  int64
+	gd         []uint32
+	compressed bool
+
+	// Sequential reads mostly hit the same grain table and grain
+	gtOffset   uint32
+	gt         []uint32
+	grainIndex int64
+	grain      []byte
+}
+
+// vmdkExtent is one extent of a descriptor based VMDK
+type vmdkExtent struct {
+	reader io.ReaderAt
+	closer io.Closer
+	start  int64
+	size   int64
+}
+
+// vmdkImage concatenates the extents listed in a VMDK descriptor
+type vmdkImage struct {
+	extents []vmdkExtent
+	size    int64
+}
+
+func openVMDK(path string) (diskImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(vmdkDescriptorMagic))
+	if _, err := io.ReadFull(file, header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	if bytes.HasPrefix(header, vmdkMagic) {
+		img, err := parseVMDKSparse(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return img, nil
+	}
+
+	defer file.Close()
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return parseVMDKDescriptor(io.LimitReader(file, vmdkMaxDescriptorLen), filepath.Dir(path))
+}
+
+func parseVMDKSparse(file *os.File) (*vmdkSparse, error) {
+	header := make([]byte, 512)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("read sparse header: %w", err)
+	}
+
+	le := binary.LittleEndian
+	gdOffset := le.Uint64(header[56:])
+	if gdOffset == vmdkGDAtEnd {
+		// streamOptimized images keep the real header in a footer placed
+		// before the end-of-stream marker
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < 1536 {
+			return nil, fmt.Errorf("VMDK footer missing")
+		}
+		if _, err := file.ReadAt(header, info.Size()-1024); err != nil {
+			return nil, fmt.Errorf("read footer: %w", err)
+		}
+		if !bytes.HasPrefix(header, vmdkMagic) {
+			return nil, fmt.Errorf("invalid VMDK footer")
+		}
+		gdOffset = le.Uint64(header[56:])
+	}
+
+	img := &vmdkSparse{
+		file:       file,
+		size:       int64(le.Uint64(header[12:])) * 512,
+		grainSize:  int64(le.Uint64(header[20:])) * 512,
+		gtEntries:  int64(le.Uint32(header[44:])),
+		compressed: le.Uint32(header[8:])&vmdkFlagCompressed != 0,
+		grainIndex: -1,
+	}
+	// Grains are 64 KiB and tables 512 entries in practice; the bounds keep a
+	// corrupt header from asking for gigabytes per grain or table
+	if img.size < 0 || img.grainSize <= 0 || img.grainSize > 16<<20 || img.gtEntries == 0 || img.gtEntries > 1<<16 {
+		return nil, fmt.Errorf("invalid VMDK grain geometry")
+	}
+	if img.compressed && le.Uint16(header[77:]) != 1 {
+		return nil, fmt.Errorf("unsupported VMDK compression algorithm %d", le.Uint16(header[77:]))
+	}
+
+	grains := (img.size + img.grainSize - 1) / img.grainSize
+	tables := (grains + img.gtEntries - 1) / img.gtEntries
+	if err := checkTable(file, "VMDK grain directory", int64(gdOffset)*512, tables*4); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, tables*4)
+	if _, err := file.ReadAt(raw, int64(gdOffset)*512); err != nil {
+		return nil, fmt.Errorf("read grain directory: %w", err)
+	}
+	img.gd = make([]uint32, tables)
+	for i := range img.gd {
+		img.gd[i] = le.Uint32(raw[i*4:])
+	}
+
+	return img, nil
+}
+
+func (v *vmdkSparse) Size() int64 {
+	return v.size
+}
+
+func (v *vmdkSparse) Close() error {
+	return v.file.Close()
+}
+
+func (v *vmdkSparse) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := v.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		pos := off + int64(read)
+		grain := pos / v.grainSize
+		inGrain := pos % v.grainSize
+		chunk := p[read:]
+		if int64(len(chunk)) > v.grainSize-inGrain {
+			chunk = chunk[:v.grainSize-inGrain]
+		}
+		if err := v.readGrain(chunk, grain, inGrain); err != nil {
+			return read, err
+		}
+		read += len(chunk)
+	}
+	return read, eof
+}
+
+func (v *vmdkSparse) readGrain(p []byte, grain, inGrain int64) error {
+	gdIndex := grain / v.gtEntries
+	if gdIndex >= int64(len(v.gd)) || v.gd[gdIndex] == 0 {
+		readZeros(p)
+		return nil
+	}
+	if err := v.loadGT(v.gd[gdIndex]); err != nil {
+		return err
+	}
+
+	sector := v.gt[grain%v.gtEntries]
+	if sector == 0 || sector == vmdkZeroGrain {
+		readZeros(p)
+		return nil
+	}
+
+	if !v.compressed {
+		if _, err := v.file.ReadAt(p, int64(sector)*512+inGrain); err != nil {
+			return fmt.Errorf("read grain %d: %w", grain, err)
+		}
+		return nil
+	}
+
+	if v.grainIndex != grain {
+		if err := v.loadCompressedGrain(int64(sector) * 512); err != nil {
+			return fmt.Errorf("read grain %d: %w", grain, err)
+		}
+		v.grainIndex = grain
+	}
+	copy(p, v.grain[inGrain:])
+	return nil
+}
+
+func (v *vmdkSparse) loadGT(sector uint32) error {
+	if v.gt != nil && v.gtOffset == sector {
+		return nil
+	}
+	raw := make([]byte, v.gtEntries*4)
+	if _, err := v.file.ReadAt(raw, int64(sector)*512); err != nil {
+		return fmt.Errorf("read grain table: %w", err)
+	}
+	if v.gt == nil {
+		v.gt = make([]uint32, v.gtEntries)
+	}
+	for i := range v.gt {
+		v.gt[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+	v.gtOffset = sector
+	return nil
+}
+
+// loadCompressedGrain inflates a grain stored as a marker (LBA and size)
+// followed by zlib data
+func (v *vmdkSparse) loadCompressedGrain(offset int64) error {
+	v.grainIndex = -1
+	marker := make([]byte, 12)
+	if _, err := v.file.ReadAt(marker, offset); err != nil {
+		return err
+	}
+	size := int64(binary.LittleEndian.Uint32(marker[8:]))
+
+	zr, err := zlib.NewReader(io.NewSectionReader(v.file, offset+12, size))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	if v.grain == nil {
+		v.grain = make([]byte, v.grainSize)
+	}
+	n, err := io.ReadFull(zr, v.grain)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	readZeros(v.grain[n:])
+	return nil
+}
+
+// parseVMDKDescriptor opens the extents listed in a text descriptor, e.g.
+//
+//	RW 4192256 SPARSE "disk-s001.vmdk"
+//	RW 8388608 FLAT "disk-flat.vmdk" 0
+func parseVMDKDescriptor(r io.Reader, dir string) (*vmdkImage, error) {
+	img := &vmdkImage{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "parentFileNameHint") {
+			img.Close()
+			return nil, fmt.Errorf("VMDK images with a parent disk are not supported")
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[0] != "RW" && fields[0] != "RDONLY" && fields[0] != "NOACCESS") {
+			continue
+		}
+
+		sectors, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			img.Close()
+			return nil, fmt.Errorf("invalid extent size: %s", line)
+		}
+		extent := vmdkExtent{start: img.size, size: sectors * 512}
+
+		switch fields[2] {
+		case "ZERO":
+			extent.reader = zeroReader{}
+		case "FLAT", "VMFS", "SPARSE":
+			name, offset, err := parseExtentFile(line)
+			if err != nil {
+				img.Close()
+				return nil, err
+			}
+			// Extents must sit next to the descriptor, so a descriptor can't
+			// expose files or devices the user didn't choose to mount
+			if filepath.IsAbs(name) || slices.Contains(strings.Split(filepath.ToSlash(name), "/"), "..") {
+				img.Close()
+				return nil, fmt.Errorf("extent %s is outside the directory of the descriptor", name)
+			}
+			name = filepath.Join(dir, name)
+			if err := validateSafePath(name); err != nil {
+				img.Close()
+				return nil, fmt.Errorf("extent %s: %w", name, err)
+			}
+			file, err := os.Open(name)
+			if err != nil {
+				img.Close()
+				return nil, fmt.Errorf("open extent: %w", err)
+			}
+			extent.closer = file
+			if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+				file.Close()
+				img.Close()
+				return nil, fmt.Errorf("extent %s is not a regular file", name)
+			}
+			if fields[2] == "SPARSE" {
+				sparse, err := parseVMDKSparse(file)
+				if err != nil {
+					file.Close()
+					img.Close()
+					return nil, fmt.Errorf("extent %s: %w", name, err)
+				}
+				extent.reader = sparse
+			} else {
+				extent.reader = io.NewSectionReader(file, offset*512, extent.size)
+			}
+		default:
+			img.Close()
+			return nil, fmt.Errorf("unsupported VMDK extent type %s", fields[2])
+		}
+
+		img.extents = append(img.extents, extent)
+		img.size += extent.size
+	}
+	if err := scanner.Err(); err != nil {
+		img.Close()
+		return nil, fmt.Errorf("read descriptor: %w", err)
+	}
+	if len(img.extents) == 0 {
+		return nil, fmt.Errorf("VMDK descriptor lists no extents")
+	}
+	return img, nil
+}
+
+// parseExtentFile returns the quoted file name and optional sector offset
+// of an extent line
+func parseExtentFile(line string) (string, int64, error) {
+	start := strings.Index(line, "\"")
+	end := strings.LastIndex(line, "\"")
+	if start < 0 || end <= start {
+		return "", 0, fmt.Errorf("invalid extent line: %s", line)
+	}
+	name := line[start+1 : end]
+
+	var offset int64
+	if rest := strings.TrimSpace(line[end+1:]); rest != "" {
+		var err error
+		if offset, err = strconv.ParseInt(strings.Fields(rest)[0], 10, 64); err != nil {
+			return "", 0, fmt.Errorf("invalid extent offset: %s", line)
+		}
+	}
+	return name, offset, nil
+}
+
+func (v *vmdkImage) Size() int64 {
+	return v.size
+}
+
+func (v *vmdkImage) Close() error {
+	for _, e := range v.extents {
+		if e.closer != nil {
+			e.closer.Close()
+		}
+	}
+	return nil
+}
+
+func (v *vmdkImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := v.size - off; int64(len(p)) > remaining {
+		p = p[:remaining]
+		eof = io.EOF
+	}
+
+	read := 0
+	for _, e := range v.extents {
+		if read == len(p) {
+			break
+		}
+		pos := off + int64(read)
+		if pos >= e.start+e.size {
+			continue
+		}
+		chunk := p[read:]
+		if int64(len(chunk)) > e.start+e.size-pos {
+			chunk = chunk[:e.start+e.size-pos]
+		}
+		n, err := e.reader.ReadAt(chunk, pos-e.start)
+		if err != nil && !(err == io.EOF && n == len(chunk)) {
+			return read + n, err
+		}
+		read += n
+	}
+	return read, eof
+}
+
+// zeroReader reads as an endless run of zeros
+type zeroReader struct{}
+
+func (zeroReader) ReadAt(p []byte, off int64) (int, error) {
+	return readZeros(p), nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Path references name a file on removable storage by its filesystem
+// instead of by mount point, which changes with the slot and Android version
+const (
+	volumePrefix      = "volume:"
+	volumeLabelPrefix = "volume-label:"
+)
+
+// Directories where vold mounts removable volumes under their UUID
+var volumeDirs = []string{"/mnt/media_rw", "/storage"}
+
+// isPathRef reports whether a path needs resolving before it can be used
+func isPathRef(path string) bool {
+	return strings.HasPrefix(path, volumePrefix) || strings.HasPrefix(path, volumeLabelPrefix) ||
+		strings.HasPrefix(path, "~") || strings.Contains(path, "$")
+}
+
+// resolvePath expands environment variables and ~ in a path and resolves
+// volume:UUID/path and volume-label:NAME/path against the mounted volumes.
+// Plain paths are made absolute.
+func resolvePath(ref string) (string, error) {
+	path, err := expandPath(ref)
+	if err != nil {
+		return "", err
+	}
+
+	var byLabel bool
+	var rest string
+	switch {
+	case strings.HasPrefix(path, volumePrefix):
+		rest = strings.TrimPrefix(path, volumePrefix)
+	case strings.HasPrefix(path, volumeLabelPrefix):
+		rest = strings.TrimPrefix(path, volumeLabelPrefix)
+		byLabel = true
+	default:
+		return filepath.Abs(path)
+	}
+
+	id, file, _ := strings.Cut(rest, "/")
+	if id == "" {
+		return "", fmt.Errorf("missing volume in %s (e.g. volume:1A2B-3C4D/image.iso)", ref)
+	}
+	mountPoint, err := findVolume(id, byLabel)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mountPoint, file), nil
+}
+
+// expandPath replaces $VAR, ${VAR} and a leading ~ in a path
+func expandPath(path string) (string, error) {
+	var missing []string
+	path = os.Expand(path, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s is not set", missing[0])
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("expand ~: %w", err)
+		}
+		path = home + path[1:]
+	}
+	return path, nil
+}
+
+// mountEntry is a line of /proc/mounts
+type mountEntry struct {
+	device     string
+	mountPoint string
+}
+
+// readMounts lists the mounted filesystems
+func readMounts() ([]mountEntry, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			mounts = append(mounts, mountEntry{unescapeMount(fields[0]), unescapeMount(fields[1])})
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes /proc/mounts uses for spaces
+func unescapeMount(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// findVolume returns where the volume with the given UUID or label is
+// mounted, checking vold's mount points before reading superblocks
+func findVolume(id string, byLabel bool) (string, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return "", fmt.Errorf("read mounts: %w", err)
+	}
+
+	if !byLabel {
+		for _, dir := range volumeDirs {
+			for _, mount := range mounts {
+				if filepath.Dir(mount.mountPoint) == dir && strings.EqualFold(filepath.Base(mount.mountPoint), id) {
+					return mount.mountPoint, nil
+				}
+			}
+		}
+	}
+
+	// Prefer the first mount of a device, which on Android is the block
+	// mount under /mnt/media_rw rather than a bind or fuse view of it
+	seen := map[string]bool{}
+	for _, mount := range mounts {
+		if !strings.HasPrefix(mount.device, "/dev/") || seen[mount.device] {
+			continue
+		}
+		seen[mount.device] = true
+		info, err := readVolumeInfo(mount.device)
+		if err != nil {
+			continue
+		}
+		if byLabel && info.Label != "" && info.Label == id || !byLabel && strings.EqualFold(info.UUID, id) {
+			logger.Info("Found volume", "volume", id, "device", mount.device, "mount", mount.mountPoint)
+			return mount.mountPoint, nil
+		}
+	}
+
+	if byLabel {
+		return "", fmt.Errorf("no mounted volume is labeled %s\nHint: Insert the storage, or use --wait on boot", id)
+	}
+	return "", fmt.Errorf("volume %s is not mounted\nHint: Insert the storage, or use --wait on boot", id)
+}
+
+// volumeInfo is the identity of a filesystem as blkid and vold report it
+type volumeInfo struct {
+	Type  string
+	UUID  string
+	Label string
+}
+
+// readVolumeInfo reads the UUID and label of the FAT, exFAT, NTFS, ext or
+// f2fs filesystem on a device
+func readVolumeInfo(device string) (*volumeInfo, error) {
+	file, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sb := make([]byte, 4096)
+	if _, err := file.ReadAt(sb, 0); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case binary.LittleEndian.Uint16(sb[1024+56:]) == 0xEF53:
+		u := sb[1024+104 : 1024+120]
+		return &volumeInfo{
+			Type:  "ext4",
+			UUID:  fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]),
+			Label: cString(sb[1024+120 : 1024+136]),
+		}, nil
+	case binary.LittleEndian.Uint32(sb[1024:]) == 0xF2F52010:
+		u := sb[1024+108 : 1024+124]
+		name := make([]uint16, 512)
+		for i := range name {
+			name[i] = binary.LittleEndian.Uint16(sb[1024+124+2*i:])
+		}
+		return &volumeInfo{
+			Type:  "f2fs",
+			UUID:  fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]),
+			Label: utf16String(name),
+		}, nil
+	case string(sb[3:11]) == "EXFAT   ":
+		serial := binary.LittleEndian.Uint32(sb[100:])
+		info := &volumeInfo{Type: "exfat", UUID: fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF)}
+		info.Label = readExFATLabel(file, sb)
+		return info, nil
+	case string(sb[3:11]) == "NTFS    ":
+		return &volumeInfo{Type: "ntfs", UUID: fmt.Sprintf("%016X", binary.LittleEndian.Uint64(sb[72:]))}, nil
+	case sb[510] == 0x55 && sb[511] == 0xAA && string(sb[82:87]) == "FAT32":
+		serial := binary.LittleEndian.Uint32(sb[67:])
+		info := &volumeInfo{Type: "vfat", UUID: fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF)}
+		info.Label = readFATLabel(file, sb, sb[71:82])
+		return info, nil
+	case sb[510] == 0x55 && sb[511] == 0xAA && string(sb[54:57]) == "FAT":
+		serial := binary.LittleEndian.Uint32(sb[39:])
+		info := &volumeInfo{Type: "vfat", UUID: fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF)}
+		info.Label = readFATLabel(file, sb, sb[43:54])
+		return info, nil
+	}
+	return nil, fmt.Errorf("unknown filesystem on %s", device)
+}
+
+// readFATLabel returns the volume label from the root directory, where Windows
+// writes it, falling back to the copy in the boot sector
+func readFATLabel(file *os.File, sb, bootLabel []byte) string {
+	sectorSize := int64(binary.LittleEndian.Uint16(sb[11:]))
+	clusterSize := sectorSize * int64(sb[13])
+	reserved := int64(binary.LittleEndian.Uint16(sb[14:]))
+	fats := int64(sb[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(sb[17:]))
+	fatSize := int64(binary.LittleEndian.Uint16(sb[22:]))
+
+	var rootStart, rootSize int64
+	if fatSize == 0 {
+		// FAT32 keeps the root directory in a cluster chain, of which the
+		// first cluster is enough to find the label
+		fatSize = int64(binary.LittleEndian.Uint32(sb[36:]))
+		rootCluster := int64(binary.LittleEndian.Uint32(sb[44:]))
+		rootStart = (reserved+fats*fatSize)*sectorSize + (rootCluster-2)*clusterSize
+		rootSize = clusterSize
+	} else {
+		rootStart = (reserved + fats*fatSize) * sectorSize
+		rootSize = rootEntries * 32
+	}
+
+	if sectorSize > 0 && rootSize > 0 && rootSize <= 1<<20 {
+		root := make([]byte, rootSize)
+		if _, err := file.ReadAt(root, rootStart); err == nil {
+			for i := 0; i+32 <= len(root); i += 32 {
+				entry := root[i : i+32]
+				if entry[0] == 0 {
+					break
+				}
+				// A volume label entry, not a long name or a deleted entry
+				if entry[0] != 0xE5 && entry[11]&0x3F == 0x08 {
+					return strings.TrimRight(string(entry[:11]), " ")
+				}
+			}
+		}
+	}
+
+	label := strings.TrimRight(string(bootLabel), " ")
+	if label == "NO NAME" {
+		return ""
+	}
+	return label
+}
+
+// readExFATLabel returns the label from the volume label entry of an exFAT
+// root directory
+func readExFATLabel(file *os.File, sb []byte) string {
+	sectorShift := sb[108]
+	clusterShift := sb[109]
+	if sectorShift < 9 || sectorShift > 12 || clusterShift > 25-sectorShift {
+		return ""
+	}
+	heapOffset := int64(binary.LittleEndian.Uint32(sb[88:])) << sectorShift
+	rootCluster := int64(binary.LittleEndian.Uint32(sb[96:]))
+	clusterSize := int64(1) << (sectorShift + clusterShift)
+
+	root := make([]byte, min(clusterSize, 1<<20))
+	if _, err := file.ReadAt(root, heapOffset+(rootCluster-2)*clusterSize); err != nil {
+		return ""
+	}
+	for i := 0; i+32 <= len(root); i += 32 {
+		entry := root[i : i+32]
+		switch entry[0] {
+		case 0x00:
+			return ""
+		case 0x83:
+			length := min(int(entry[1]), 11)
+			name := make([]uint16, length)
+			for j := range name {
+				name[j] = binary.LittleEndian.Uint16(entry[2+2*j:])
+			}
+			return string(utf16.Decode(name))
+		}
+	}
+	return ""
+}
+
+// cString returns the bytes up to the first NUL
+func cString(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// utf16String decodes UTF-16 code units up to the first NUL
+func utf16String(units []uint16) string {
+	for i, unit := range units {
+		if unit == 0 {
+			units = units[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(units))
+}